@@ -4,11 +4,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/openfaas/connector-sdk/types"
@@ -72,9 +76,23 @@ func main() {
 	// by sleeping for 10 seconds between emitting the same message
 	messageID := 0
 
+	// Stop emitting and drain in-flight invocations on Control+C or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	t := time.NewTicker(interval)
 	for {
-		<-t.C
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+			defer cancel()
+
+			if err := controller.Shutdown(shutdownCtx); err != nil {
+				log.Printf("[tester] shutdown: %s", err)
+			}
+			return
+		}
 
 		log.Printf("[tester] Emitting event on topic payment.received - %s\n", gateway)
 
@@ -82,12 +100,22 @@ func main() {
 		// Add a de-dupe header to the message
 		h.Add("X-Message-Id", fmt.Sprintf("%d", messageID))
 
+		createdAt := time.Now()
 		payload, _ := json.Marshal(samplePayload{
-			CreatedAt: time.Now(),
+			CreatedAt: createdAt,
 			MessageID: messageID,
 		})
 
-		controller.Invoke(topic, &payload, h)
+		err := controller.Publish(ctx, types.Message{
+			Topic:     topic,
+			ID:        fmt.Sprintf("%d", messageID),
+			Timestamp: createdAt,
+			Body:      payload,
+			Header:    h,
+		})
+		if err != nil {
+			log.Printf("[tester] message %d not delivered: %s", messageID, err)
+		}
 
 		messageID++
 
@@ -110,7 +138,7 @@ type ResponseReceiver struct {
 func (ResponseReceiver) Response(res types.InvokerResponse) {
 	if res.Error != nil {
 		log.Printf("[tester] error: %s", res.Error.Error())
-	} else {
+	} else if res.Body != nil {
 		log.Printf("[tester] result: [%d] %s => %s (%d) bytes (%fs)", res.Status, res.Topic, res.Function, len(*res.Body), res.Duration.Seconds())
 	}
 }
@@ -5,4 +5,5 @@ go 1.18
 require (
 	github.com/alexellis/go-execute v0.5.0
 	github.com/openfaas/faas-provider v0.19.1
+	gopkg.in/yaml.v3 v3.0.1
 )
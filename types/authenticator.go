@@ -0,0 +1,317 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openfaas/faas-provider/auth"
+)
+
+// Authenticator adds credentials to a request to the gateway, both for
+// listing functions and for invoking them.
+type Authenticator interface {
+	// Authenticate sets the credentials on req, i.e. its Authorization
+	// header
+	Authenticate(req *http.Request) error
+}
+
+// TokenSource returns a bearer token, which it may cache and refresh.
+type TokenSource interface {
+	// Token returns a valid token, or an error if one cannot be obtained
+	Token(ctx context.Context) (string, error)
+}
+
+// StaticTokenSource is a TokenSource which always returns the same token
+type StaticTokenSource string
+
+// Token implements TokenSource
+func (s StaticTokenSource) Token(ctx context.Context) (string, error) {
+	return string(s), nil
+}
+
+// BearerAuthenticator sets a bearer token from a TokenSource in the
+// Authorization header.
+type BearerAuthenticator struct {
+	Source TokenSource
+}
+
+// NewBearerAuthenticator creates an Authenticator for the tokens of source,
+// use StaticTokenSource for a fixed token.
+func NewBearerAuthenticator(source TokenSource) *BearerAuthenticator {
+	return &BearerAuthenticator{
+		Source: source,
+	}
+}
+
+// Authenticate implements Authenticator
+func (a *BearerAuthenticator) Authenticate(req *http.Request) error {
+	token, err := a.Source.Token(req.Context())
+	if err != nil {
+		return fmt.Errorf("unable to get bearer token, error: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// BasicAuthenticator sets basic auth credentials on each request.
+type BasicAuthenticator struct {
+	Credentials *auth.BasicAuthCredentials
+}
+
+// NewBasicAuthenticator creates an Authenticator for credentials, such as
+// those from ReadCredentials.
+func NewBasicAuthenticator(credentials *auth.BasicAuthCredentials) *BasicAuthenticator {
+	return &BasicAuthenticator{
+		Credentials: credentials,
+	}
+}
+
+// Authenticate implements Authenticator
+func (a *BasicAuthenticator) Authenticate(req *http.Request) error {
+	if a.Credentials == nil {
+		return fmt.Errorf("no basic auth credentials")
+	}
+
+	req.SetBasicAuth(a.Credentials.User, a.Credentials.Password)
+	return nil
+}
+
+// DefaultTokenExpiryDelta is how long before it expires a cached token is
+// refreshed by ClientCredentialsTokenSource.
+const DefaultTokenExpiryDelta = 10 * time.Second
+
+// ClientCredentialsTokenSource fetches tokens with the OAuth2 client
+// credentials grant, i.e. from an OIDC provider. Each token is cached until
+// ExpiryDelta before it expires.
+type ClientCredentialsTokenSource struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+
+	// EndpointParams are added to the token request, i.e. "audience"
+	EndpointParams url.Values
+
+	// AuthInBody sends the client ID and secret as form parameters
+	// instead of with basic auth.
+	AuthInBody bool
+
+	// ExpiryDelta refreshes a token early, DefaultTokenExpiryDelta if
+	// zero.
+	ExpiryDelta time.Duration
+
+	// Client requests tokens from TokenURL
+	Client *http.Client
+
+	token  string
+	expiry time.Time
+	lock   sync.Mutex
+}
+
+// NewClientCredentialsTokenSource creates a TokenSource for the client
+// credentials grant of the token endpoint at tokenURL.
+func NewClientCredentialsTokenSource(tokenURL, clientID, clientSecret string, scopes []string) *ClientCredentialsTokenSource {
+	return &ClientCredentialsTokenSource{
+		TokenURL:     tokenURL,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Scopes:       scopes,
+		Client:       MakeClient(30 * time.Second),
+	}
+}
+
+// tokenResponse is the response of an OAuth2 token endpoint
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// Token implements TokenSource, returning the cached token or fetching a
+// new one. Concurrent callers wait for a single request.
+func (s *ClientCredentialsTokenSource) Token(ctx context.Context) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delta := s.ExpiryDelta
+	if delta == 0 {
+		delta = DefaultTokenExpiryDelta
+	}
+
+	if len(s.token) > 0 && (s.expiry.IsZero() || time.Now().Add(delta).Before(s.expiry)) {
+		return s.token, nil
+	}
+
+	token, expiry, err := s.fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	s.token, s.expiry = token, expiry
+	return token, nil
+}
+
+// fetch requests a new token from the TokenURL
+func (s *ClientCredentialsTokenSource) fetch(ctx context.Context) (string, time.Time, error) {
+	form := url.Values{}
+	for key, values := range s.EndpointParams {
+		form[key] = append([]string{}, values...)
+	}
+	form.Set("grant_type", "client_credentials")
+	if len(s.Scopes) > 0 {
+		form.Set("scope", strings.Join(s.Scopes, " "))
+	}
+	if s.AuthInBody {
+		form.Set("client_id", s.ClientID)
+		form.Set("client_secret", s.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if !s.AuthInBody {
+		req.SetBasicAuth(url.QueryEscape(s.ClientID), url.QueryEscape(s.ClientSecret))
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	start := time.Now()
+	res, err := client.Do(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("unable to request token from %s, error: %w", s.TokenURL, err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("unable to read token response from %s, error: %w", s.TokenURL, err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("unexpected status code from %s: %d, body: %s", s.TokenURL, res.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var token tokenResponse
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", time.Time{}, fmt.Errorf("unable to parse token response from %s, error: %w", s.TokenURL, err)
+	}
+	if len(token.AccessToken) == 0 {
+		return "", time.Time{}, fmt.Errorf("no access_token in token response from %s", s.TokenURL)
+	}
+
+	var expiry time.Time
+	if token.ExpiresIn > 0 {
+		expiry = start.Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+
+	return token.AccessToken, expiry, nil
+}
+
+// AuthenticatedClient returns a copy of client which authenticates every
+// request with authenticator. Requests fail with an error when the
+// credentials cannot be obtained. A RefreshingAuthenticator is refreshed
+// when a request is rejected with 401 Unauthorized.
+func AuthenticatedClient(client *http.Client, authenticator Authenticator) *http.Client {
+	authenticated := *client
+	authenticated.Transport = &authTransport{
+		next:          client.Transport,
+		authenticator: authenticator,
+	}
+
+	return &authenticated
+}
+
+// authTransport authenticates each request before sending it with next
+type authTransport struct {
+	next          http.RoundTripper
+	authenticator Authenticator
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the caller's request
+	authenticated := req.Clone(req.Context())
+
+	if err := t.authenticator.Authenticate(authenticated); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, fmt.Errorf("unable to authenticate request to %s, error: %w", req.URL.Redacted(), err)
+	}
+
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	res, err := next.RoundTrip(authenticated)
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+
+	refresher, ok := t.authenticator.(RefreshingAuthenticator)
+	if !ok {
+		return res, nil
+	}
+
+	changed, err := refresher.Refresh(req.Context())
+	if err != nil {
+		log.Printf("[connector] unable to refresh credentials after %d from %s, error: %s", res.StatusCode, req.URL.Redacted(), err)
+		return res, nil
+	}
+
+	// Only retry when the credentials changed and the body can be sent again
+	if !changed || (req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+		return res, nil
+	}
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return res, nil
+		}
+	}
+
+	if err := t.authenticator.Authenticate(retry); err != nil {
+		if retry.Body != nil {
+			retry.Body.Close()
+		}
+		return res, nil
+	}
+
+	_, _ = io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+
+	return next.RoundTrip(retry)
+}
+
+// CloseIdleConnections closes the idle connections of the wrapped transport
+func (t *authTransport) CloseIdleConnections() {
+	type closeIdler interface {
+		CloseIdleConnections()
+	}
+
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if c, ok := next.(closeIdler); ok {
+		c.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/openfaas/faas-provider/auth"
+)
+
+func Test_Authenticators(t *testing.T) {
+	var TestCases = []struct {
+		Name          string
+		Authenticator Authenticator
+		Expected      string
+	}{
+		{
+			Name:          "Static bearer token",
+			Authenticator: NewBearerAuthenticator(StaticTokenSource("token1")),
+			Expected:      "Bearer token1",
+		},
+		{
+			Name:          "Basic auth",
+			Authenticator: NewBasicAuthenticator(&auth.BasicAuthCredentials{User: "admin", Password: "secret"}),
+			Expected:      "Basic YWRtaW46c2VjcmV0",
+		},
+	}
+
+	for _, test := range TestCases {
+		t.Run(test.Name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, "http://gateway:8080/system/functions", nil)
+			if err := test.Authenticator.Authenticate(req); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := req.Header.Get("Authorization"); got != test.Expected {
+				t.Errorf("Authorization - want: %s, got: %s", test.Expected, got)
+			}
+		})
+	}
+}
+
+func Test_ClientCredentialsTokenSource_CachesAndRefreshes(t *testing.T) {
+	var issued int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if err := r.ParseForm(); err != nil || id != "connector" || secret != "secret" ||
+			r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("scope") != "functions:invoke" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		n := atomic.AddInt32(&issued, 1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token": "token%d", "token_type": "Bearer", "expires_in": 1}`, n)
+	}))
+	defer srv.Close()
+
+	source := NewClientCredentialsTokenSource(srv.URL, "connector", "secret", []string{"functions:invoke"})
+	source.ExpiryDelta = 500 * time.Millisecond
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if token, err := source.Token(context.Background()); err != nil || token != "token1" {
+				t.Errorf("Token - want: %s, got: %s, error: %v", "token1", token, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	time.Sleep(600 * time.Millisecond)
+
+	token, err := source.Token(context.Background())
+	if err != nil || token != "token2" {
+		t.Errorf("Token after expiry - want: %s, got: %s, error: %v", "token2", token, err)
+	}
+	if got := atomic.LoadInt32(&issued); got != 2 {
+		t.Errorf("Tokens issued - want: %d, got: %d", 2, got)
+	}
+}
+
+func Test_ClientCredentialsTokenSource_Error(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"error": "invalid_client"}`))
+	}))
+	defer srv.Close()
+
+	source := NewClientCredentialsTokenSource(srv.URL, "connector", "wrong", nil)
+	if _, err := source.Token(context.Background()); err == nil || !strings.Contains(err.Error(), "invalid_client") {
+		t.Errorf("Error - want: invalid_client, got: %v", err)
+	}
+}
+
+func Test_Controller_AuthenticatesListingAndInvocation(t *testing.T) {
+	authorization := make(chan string, 10)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization <- r.URL.Path + " " + r.Header.Get("Authorization")
+
+		switch r.URL.Path {
+		case "/system/namespaces":
+			_, _ = w.Write([]byte(`[]`))
+		case "/system/functions":
+			_, _ = w.Write([]byte(`[{"name": "echo", "annotations": {"topic": "topic1"}}]`))
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer srv.Close()
+
+	c := NewController(&auth.BasicAuthCredentials{User: "admin", Password: "secret"}, &ControllerConfig{
+		GatewayURL:      srv.URL,
+		UpstreamTimeout: time.Second,
+		RebuildInterval: time.Minute,
+		Authenticator:   NewBearerAuthenticator(StaticTokenSource("token1")),
+	}).(*controller)
+
+	c.BeginMapBuilder()
+	defer c.Shutdown(context.Background())
+
+	select {
+	case <-c.Ready():
+	case <-time.After(time.Second):
+		t.Fatalf("Ready - want: closed after sync, got: open")
+	}
+
+	body := []byte("hello")
+	if _, err := c.InvokeAndWait(context.Background(), "topic1", &body, http.Header{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		got := <-authorization
+		path, header, _ := strings.Cut(got, " ")
+		if header != "Bearer token1" {
+			t.Errorf("Authorization for %s - want: %s, got: %s", path, "Bearer token1", header)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of the circuit for a single function
+type CircuitState string
+
+const (
+	// CircuitClosed functions are invoked as normal
+	CircuitClosed CircuitState = "closed"
+
+	// CircuitOpen invocations are short-circuited without calling the function
+	CircuitOpen CircuitState = "open"
+
+	// CircuitHalfOpen a single trial invocation is let through to decide
+	// whether to close the circuit again
+	CircuitHalfOpen CircuitState = "half-open"
+)
+
+// DefaultFailureThreshold is the number of consecutive failed invocations
+// which opens the circuit when no FailureThreshold is set.
+const DefaultFailureThreshold = 5
+
+// CircuitBreakerConfig configures the per-function circuit breaker
+type CircuitBreakerConfig struct {
+	// FailureThreshold is the number of consecutive failed invocations which opens the circuit.
+	// Optional, if not set DefaultFailureThreshold is used.
+	FailureThreshold int
+
+	// OpenTimeout is how long the circuit stays open before a trial invocation is let through.
+	OpenTimeout time.Duration
+
+	// SuccessThreshold is the number of consecutive successful trial invocations which close the circuit.
+	// Optional, if not set a single success closes the circuit.
+	SuccessThreshold int
+}
+
+// CircuitStateChange is published when the circuit for a function changes state
+type CircuitStateChange struct {
+	Function string
+	From     CircuitState
+	To       CircuitState
+	Time     time.Time
+}
+
+// CircuitBreakerSubscriber can be implemented by a ResponseSubscriber to
+// also receive circuit state changes. The same note about blocking
+// applies as for ResponseSubscriber.
+type CircuitBreakerSubscriber interface {
+	// CircuitStateChanged is triggered by the controller when the circuit
+	// for a function opens, half-opens or closes
+	CircuitStateChanged(CircuitStateChange)
+}
+
+// CircuitOpenError is the error of an invocation which was short-circuited
+// because the circuit for the function is open.
+type CircuitOpenError struct {
+	Function string
+
+	// RetryAt is when the next trial invocation will be let through
+	RetryAt time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit open for %s until %s", e.Function, e.RetryAt.Format(time.RFC3339))
+}
+
+// CircuitBreaker tracks the circuit for each function by the name returned
+// from TopicMap.Match. Failures are network errors and 5xx status codes.
+// A nil CircuitBreaker lets every invocation through.
+type CircuitBreaker struct {
+	config   CircuitBreakerConfig
+	onChange func(CircuitStateChange)
+
+	circuits map[string]*circuit
+	lock     sync.Mutex
+}
+
+type circuit struct {
+	state     CircuitState
+	failures  int
+	successes int
+	openedAt  time.Time
+
+	// trial is true while a half-open trial invocation is in flight
+	trial bool
+}
+
+// NewCircuitBreaker creates a CircuitBreaker which calls onChange, if not
+// nil, whenever the circuit for a function changes state.
+func NewCircuitBreaker(config CircuitBreakerConfig, onChange func(CircuitStateChange)) *CircuitBreaker {
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = DefaultFailureThreshold
+	}
+
+	return &CircuitBreaker{
+		config:   config,
+		onChange: onChange,
+		circuits: make(map[string]*circuit),
+	}
+}
+
+// State returns the state of the circuit for function
+func (b *CircuitBreaker) State(function string) CircuitState {
+	if b == nil {
+		return CircuitClosed
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if c, ok := b.circuits[function]; ok {
+		return c.state
+	}
+	return CircuitClosed
+}
+
+// Allow returns a *CircuitOpenError if function must not be invoked,
+// otherwise the caller must report the result with Record or Release.
+func (b *CircuitBreaker) Allow(function string) error {
+	if b == nil {
+		return nil
+	}
+
+	var change *CircuitStateChange
+
+	err := func() error {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+
+		c, ok := b.circuits[function]
+		if !ok || c.state == CircuitClosed {
+			return nil
+		}
+
+		retryAt := c.openedAt.Add(b.config.OpenTimeout)
+		if c.state == CircuitOpen {
+			if time.Now().Before(retryAt) {
+				return &CircuitOpenError{Function: function, RetryAt: retryAt}
+			}
+			change = b.transition(function, c, CircuitHalfOpen)
+		}
+
+		if c.trial {
+			return &CircuitOpenError{Function: function, RetryAt: retryAt}
+		}
+
+		c.trial = true
+		return nil
+	}()
+
+	b.notify(change)
+	return err
+}
+
+// Record reports the result of an invocation let through by Allow.
+func (b *CircuitBreaker) Record(function string, success bool) {
+	if b == nil {
+		return
+	}
+
+	var change *CircuitStateChange
+
+	func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+
+		c, ok := b.circuits[function]
+		if !ok {
+			if success {
+				return
+			}
+			c = &circuit{state: CircuitClosed}
+			b.circuits[function] = c
+		}
+
+		switch c.state {
+		case CircuitClosed:
+			if success {
+				c.failures = 0
+				return
+			}
+
+			c.failures++
+			if c.failures >= b.config.FailureThreshold {
+				change = b.transition(function, c, CircuitOpen)
+			}
+
+		case CircuitHalfOpen:
+			c.trial = false
+			if !success {
+				change = b.transition(function, c, CircuitOpen)
+				return
+			}
+
+			c.successes++
+			if c.successes >= b.config.SuccessThreshold {
+				change = b.transition(function, c, CircuitClosed)
+			}
+		}
+	}()
+
+	b.notify(change)
+}
+
+// Release reports that an invocation let through by Allow ended without
+// a result, for instance because it was cancelled.
+func (b *CircuitBreaker) Release(function string) {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if c, ok := b.circuits[function]; ok {
+		c.trial = false
+	}
+}
+
+// transition must be called with the lock held.
+func (b *CircuitBreaker) transition(function string, c *circuit, to CircuitState) *CircuitStateChange {
+	change := &CircuitStateChange{
+		Function: function,
+		From:     c.state,
+		To:       to,
+		Time:     time.Now(),
+	}
+
+	c.state = to
+	c.failures = 0
+	c.successes = 0
+	c.trial = false
+
+	switch to {
+	case CircuitOpen:
+		c.openedAt = change.Time
+	case CircuitClosed:
+		delete(b.circuits, function)
+	}
+
+	return change
+}
+
+func (b *CircuitBreaker) notify(change *CircuitStateChange) {
+	if change != nil && b.onChange != nil {
+		b.onChange(*change)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_CircuitBreaker_States(t *testing.T) {
+	var changes []CircuitStateChange
+	breaker := NewCircuitBreaker(CircuitBreakerConfig{
+		FailureThreshold: 2,
+		OpenTimeout:      20 * time.Millisecond,
+	}, func(change CircuitStateChange) {
+		changes = append(changes, change)
+	})
+
+	fn := "echo.openfaas-fn"
+
+	for i := 0; i < 2; i++ {
+		if err := breaker.Allow(fn); err != nil {
+			t.Fatalf("Allow %d - want: no error, got: %s", i, err)
+		}
+		breaker.Record(fn, false)
+	}
+
+	if got := breaker.State(fn); got != CircuitOpen {
+		t.Fatalf("State - want: %s, got: %s", CircuitOpen, got)
+	}
+
+	var openErr *CircuitOpenError
+	if err := breaker.Allow(fn); !errors.As(err, &openErr) {
+		t.Fatalf("Allow while open - want: *CircuitOpenError, got: %v", err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	if err := breaker.Allow(fn); err != nil {
+		t.Fatalf("Allow trial - want: no error, got: %s", err)
+	}
+	if err := breaker.Allow(fn); !errors.As(err, &openErr) {
+		t.Fatalf("Allow during trial - want: *CircuitOpenError, got: %v", err)
+	}
+
+	breaker.Record(fn, true)
+
+	if got := breaker.State(fn); got != CircuitClosed {
+		t.Fatalf("State - want: %s, got: %s", CircuitClosed, got)
+	}
+
+	want := []CircuitState{CircuitOpen, CircuitHalfOpen, CircuitClosed}
+	if len(changes) != len(want) {
+		t.Fatalf("State changes - want: %d, got: %d", len(want), len(changes))
+	}
+	for i, change := range changes {
+		if change.To != want[i] || change.Function != fn {
+			t.Errorf("State change %d - want: %s for %s, got: %s for %s", i, want[i], fn, change.To, change.Function)
+		}
+	}
+}
+
+func Test_CircuitBreaker_SuccessResetsFailures(t *testing.T) {
+	breaker := NewCircuitBreaker(CircuitBreakerConfig{
+		FailureThreshold: 2,
+		OpenTimeout:      time.Minute,
+	}, nil)
+
+	fn := "echo.openfaas-fn"
+
+	breaker.Record(fn, false)
+	breaker.Record(fn, true)
+	breaker.Record(fn, false)
+
+	if got := breaker.State(fn); got != CircuitClosed {
+		t.Errorf("State - want: %s, got: %s", CircuitClosed, got)
+	}
+}
+
+func Test_CircuitBreaker_DefaultFailureThreshold(t *testing.T) {
+	breaker := NewCircuitBreaker(CircuitBreakerConfig{
+		OpenTimeout: time.Minute,
+	}, nil)
+
+	fn := "echo.openfaas-fn"
+
+	for i := 0; i < DefaultFailureThreshold-1; i++ {
+		breaker.Record(fn, false)
+	}
+	if got := breaker.State(fn); got != CircuitClosed {
+		t.Fatalf("State - want: %s, got: %s", CircuitClosed, got)
+	}
+
+	breaker.Record(fn, false)
+	if got := breaker.State(fn); got != CircuitOpen {
+		t.Errorf("State - want: %s, got: %s", CircuitOpen, got)
+	}
+}
+
+func Test_Controller_ShortCircuitsFailingFunction(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	c := NewController(nil, &ControllerConfig{
+		GatewayURL:      srv.URL,
+		UpstreamTimeout: time.Second,
+		CircuitBreaker: &CircuitBreakerConfig{
+			FailureThreshold: 2,
+			OpenTimeout:      time.Minute,
+		},
+	})
+
+	sub := &circuitSubscriber{changes: make(chan CircuitStateChange, 1)}
+	c.Subscribe(sub)
+
+	lookup := map[string][]string{"topic1": {"broken"}}
+	c.(*controller).TopicMap.Sync(&lookup)
+
+	var TestCases = []struct {
+		Name     string
+		Status   int
+		Expected InvocationOutcome
+	}{
+		{Name: "First failure", Status: http.StatusInternalServerError, Expected: OutcomeFailed},
+		{Name: "Failure opens the circuit", Status: http.StatusInternalServerError, Expected: OutcomeFailed},
+		{Name: "Short-circuited", Expected: OutcomeShortCircuited},
+	}
+
+	var last InvokerResponse
+	for _, test := range TestCases {
+		body := []byte("hello")
+		responses, _ := c.InvokeAndWait(context.Background(), "topic1", &body, http.Header{})
+		if len(responses) != 1 {
+			t.Fatalf("%s: Responses - want: %d, got: %d", test.Name, 1, len(responses))
+		}
+
+		res := responses[0]
+		last = res
+		if res.Outcome != test.Expected || res.Status != test.Status {
+			t.Errorf("%s: Response - want: %s %d, got: %s %d", test.Name, test.Expected, test.Status, res.Outcome, res.Status)
+		}
+	}
+
+	var openErr *CircuitOpenError
+	if !errors.As(last.Error, &openErr) || openErr.Function != "broken" {
+		t.Errorf("Error - want: *CircuitOpenError for broken, got: %v", last.Error)
+	}
+
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Errorf("Calls - want: %d, got: %d", 2, got)
+	}
+
+	select {
+	case change := <-sub.changes:
+		if change.Function != "broken" || change.From != CircuitClosed || change.To != CircuitOpen {
+			t.Errorf("State change - want: broken %s to %s, got: %s %s to %s", CircuitClosed, CircuitOpen, change.Function, change.From, change.To)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("State change - want: %s, got: none", CircuitOpen)
+	}
+}
+
+type circuitSubscriber struct {
+	changes chan CircuitStateChange
+}
+
+func (s *circuitSubscriber) Response(InvokerResponse) {}
+
+func (s *circuitSubscriber) CircuitStateChanged(change CircuitStateChange) {
+	s.changes <- change
+}
@@ -5,9 +5,11 @@ package types
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"sync"
 	"time"
 
@@ -17,12 +19,22 @@ import (
 // Controller is used to invoke functions on a per-topic basis and to subscribe to responses returned by said functions.
 type Controller interface {
 	Subscribe(subscriber ResponseSubscriber)
+	Use(middleware ...Middleware)
 	Invoke(topic string, message *[]byte, headers http.Header)
 	InvokeWithContext(ctx context.Context, topic string, message *[]byte, headers http.Header)
+	InvokeAndWait(ctx context.Context, topic string, message *[]byte, headers http.Header) ([]InvokerResponse, error)
+	Publish(ctx context.Context, msg Message) error
 	BeginMapBuilder()
 	Topics() []string
+	SyncStatus() SyncStatus
+	Ready() <-chan struct{}
+	Shutdown(ctx context.Context) error
 }
 
+// ErrControllerShutdown is returned for messages published after Shutdown
+// has been called.
+var ErrControllerShutdown = errors.New("controller has been shut down")
+
 // controller is the default implementation of the Controller interface.
 type controller struct {
 	// Config for the controller
@@ -44,6 +56,48 @@ type controller struct {
 
 	// lock used for synchronizing subscribers
 	lock *sync.RWMutex
+
+	// lookupBuilder queries the gateway, set by BeginMapBuilder
+	lookupBuilder *FunctionLookupBuilder
+
+	// restored is the snapshot restored by NewController, which seeds the
+	// lookupBuilder's known functions
+	restored *TopicMapSnapshot
+
+	// inFlight counts invocations which have not yet returned
+	inFlight sync.WaitGroup
+
+	// shutdown is set once Shutdown is called, guarded by stateLock
+	shutdown  bool
+	stateLock sync.Mutex
+
+	// stop is closed by Shutdown to stop the map builder
+	stop chan struct{}
+
+	// mapBuilder counts map builders which have not yet returned
+	mapBuilder sync.WaitGroup
+
+	// done is closed to stop the response dispatcher once drained
+	done chan struct{}
+
+	// dispatched is closed once the response dispatcher has returned
+	dispatched chan struct{}
+
+	// syncStatus reports the health of the map builder, guarded by syncLock
+	syncStatus SyncStatus
+	syncLock   sync.Mutex
+
+	// ready is closed once the topic map is first synced or restored
+	ready chan struct{}
+
+	// isReady is set when ready is closed, and pendingClosed once nothing
+	// more can be buffered, both guarded by readyLock
+	isReady       bool
+	pendingClosed bool
+	readyLock     sync.Mutex
+
+	// pending buffers messages until ready, for ReadinessBuffer
+	pending chan *pendingMessage
 }
 
 // NewController create a new connector SDK controller
@@ -52,12 +106,20 @@ func NewController(credentials *auth.BasicAuthCredentials, config *ControllerCon
 	gatewayFunctionPath := gatewayRoute(config)
 
 	invoker := NewInvoker(gatewayFunctionPath,
-		MakeClient(config.UpstreamTimeout),
+		gatewayClient(config),
 		config.ContentType,
 		config.PrintResponse,
 		config.PrintRequestBody,
 		config.UserAgent)
 
+	invoker.MaxInFlight = config.MaxConcurrentInvocations
+	invoker.FanOut = config.TopicConcurrency
+	invoker.RetryPolicy = config.RetryPolicy
+	invoker.DeadLetters = config.DeadLetterSink
+	invoker.Policy = config.InvocationPolicy
+	invoker.Use(config.Middleware...)
+	invoker.MaxResponseBodyBytes = config.MaxResponseBodyBytes
+
 	subs := []ResponseSubscriber{}
 
 	topicMap := NewTopicMap()
@@ -69,35 +131,93 @@ func NewController(credentials *auth.BasicAuthCredentials, config *ControllerCon
 		Credentials: credentials,
 		Subscribers: subs,
 		lock:        &sync.RWMutex{},
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+		dispatched:  make(chan struct{}),
+		ready:       make(chan struct{}),
+	}
+
+	if config.CircuitBreaker != nil {
+		invoker.CircuitBreaker = NewCircuitBreaker(*config.CircuitBreaker, c.circuitStateChanged)
 	}
 
 	if config.PrintResponse {
 		c.Subscribe(&ResponsePrinter{config.PrintResponseBody})
 	}
 
-	go func(ch *chan InvokerResponse, controller *controller) {
-		for {
-			res := <-*ch
+	if len(config.SnapshotPath) > 0 {
+		c.restoreSnapshot()
+	}
 
-			controller.lock.RLock()
-			for _, sub := range controller.Subscribers {
-				sub.Response(res)
-			}
-			controller.lock.RUnlock()
+	if config.ReadinessPolicy == ReadinessBuffer {
+		c.pending = make(chan *pendingMessage, config.ReadinessBufferSize)
+		go c.invokePending()
+	}
+
+	for _, authenticator := range []Authenticator{config.Authenticator, config.ListAuthenticator} {
+		if watcher, ok := authenticator.(credentialsWatcher); ok {
+			watcher.Watch(c.stop)
 		}
-	}(&invoker.Responses, &c)
+	}
+
+	go c.dispatchResponses()
 
 	return &c
 }
 
+// dispatchResponses passes each response from the invoker to the
+// subscribers until the controller is shut down.
+func (c *controller) dispatchResponses() {
+	defer close(c.dispatched)
+
+	for {
+		select {
+		case res := <-c.Invoker.Responses:
+			c.lock.RLock()
+			for _, sub := range c.Subscribers {
+				sub.Response(res)
+			}
+			c.lock.RUnlock()
+		case <-c.done:
+			return
+		}
+	}
+}
+
 // Subscribe adds a ResponseSubscriber to the list of subscribers
 // which receive messages upon function invocation or error
 // Note: it is not possible to Unsubscribe at this point using
 // the API of the controller
+//
+// Subscribers which implement TopicMapListener are also notified of
+// changes to the topic map.
 func (c *controller) Subscribe(subscriber ResponseSubscriber) {
 	c.lock.Lock()
-	defer c.lock.Unlock()
 	c.Subscribers = append(c.Subscribers, subscriber)
+	c.lock.Unlock()
+
+	if listener, ok := subscriber.(TopicMapListener); ok {
+		c.TopicMap.AddListener(listener)
+	}
+}
+
+// Use adds middleware which wraps each request to a function, after any
+// from ControllerConfig.Middleware.
+func (c *controller) Use(middleware ...Middleware) {
+	c.Invoker.Use(middleware...)
+}
+
+// circuitStateChanged passes a change to each subscriber which implements
+// CircuitBreakerSubscriber.
+func (c *controller) circuitStateChanged(change CircuitStateChange) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	for _, sub := range c.Subscribers {
+		if cbs, ok := sub.(CircuitBreakerSubscriber); ok {
+			cbs.CircuitStateChanged(change)
+		}
+	}
 }
 
 // Invoke attempts to invoke any functions which match the
@@ -109,41 +229,348 @@ func (c *controller) Invoke(topic string, message *[]byte, headers http.Header)
 // InvokeWithContext attempts to invoke any functions which match the topic
 // the incoming message was published on while propagating context.
 func (c *controller) InvokeWithContext(ctx context.Context, topic string, message *[]byte, headers http.Header) {
-	c.Invoker.InvokeWithContext(ctx, c.TopicMap, topic, message, headers)
+	if err := c.begin(); err != nil {
+		log.Printf("[connector] unable to invoke topic %s, error: %s", topic, err)
+		return
+	}
+
+	msg := newMessage(topic, message, headers)
+	if queued, err := c.awaitReady(ctx, msg, nil); queued {
+		return
+	} else if err != nil {
+		c.inFlight.Done()
+		log.Printf("[connector] unable to invoke topic %s, error: %s", topic, err)
+		return
+	}
+	defer c.inFlight.Done()
+
+	c.Invoker.Publish(ctx, c.TopicMap, msg)
+}
+
+// InvokeAndWait invokes any functions which match the topic like
+// InvokeWithContext, and returns once every function has responded so that
+// the caller can acknowledge the message with its broker. The responses
+// are also delivered to subscribers. The error is non-nil if any of the
+// functions could not be invoked successfully, and nil if none matched.
+// A message buffered by ReadinessBuffer is waited for until it is invoked.
+func (c *controller) InvokeAndWait(ctx context.Context, topic string, message *[]byte, headers http.Header) ([]InvokerResponse, error) {
+	if err := c.begin(); err != nil {
+		return nil, err
+	}
+
+	msg := newMessage(topic, message, headers)
+	done := make(chan pendingResult, 1)
+	if queued, err := c.awaitReady(ctx, msg, done); queued {
+		result := <-done
+		return result.responses, result.err
+	} else if err != nil {
+		c.inFlight.Done()
+		return nil, err
+	}
+	defer c.inFlight.Done()
+
+	responses := c.Invoker.Publish(ctx, c.TopicMap, msg)
+	return responses, responsesError(topic, responses)
+}
+
+// Publish invokes any functions which match the topic of msg and waits for
+// them to respond. msg.Ack is then called if every function was invoked
+// successfully, otherwise msg.Nack is called with the error, which is
+// also returned. If no functions match, the message is acknowledged.
+// A message buffered by ReadinessBuffer is acknowledged or nacked once it
+// has been invoked, and Publish returns nil straight away.
+func (c *controller) Publish(ctx context.Context, msg Message) error {
+	if err := c.begin(); err != nil {
+		return msg.settle(err)
+	}
+
+	if queued, err := c.awaitReady(ctx, &msg, nil); queued {
+		return nil
+	} else if err != nil {
+		c.inFlight.Done()
+		return msg.settle(err)
+	}
+	defer c.inFlight.Done()
+
+	responses := c.Invoker.Publish(ctx, c.TopicMap, &msg)
+	return msg.settle(responsesError(msg.Topic, responses))
+}
+
+// redrive invokes the function of a dead letter again with its message,
+// provided the function still subscribes to the letter's topic.
+func (c *controller) redrive(ctx context.Context, letter DeadLetter) (InvokerResponse, error) {
+	if err := c.begin(); err != nil {
+		return InvokerResponse{}, err
+	}
+	defer c.inFlight.Done()
+
+	subscribed := false
+	for _, function := range c.TopicMap.Match(letter.Topic) {
+		if function == letter.Function {
+			subscribed = true
+			break
+		}
+	}
+	if !subscribed {
+		return InvokerResponse{}, fmt.Errorf("%s does not subscribe to topic %s", letter.Function, letter.Topic)
+	}
+
+	msg := &Message{
+		ID:     letter.ID,
+		Topic:  letter.Topic,
+		Body:   letter.Body,
+		Header: letter.Header,
+	}
+
+	return c.Invoker.redrive(ctx, c.TopicMap, letter.Function, msg), nil
+}
+
+// responsesError summarises any unsuccessful responses as an error.
+// Invocations denied by the InvocationPolicy are not failures, since
+// redelivering the message would be denied again.
+func responsesError(topic string, responses []InvokerResponse) error {
+	failed := 0
+	for _, res := range responses {
+		if res.Outcome != OutcomeSucceeded && res.Outcome != OutcomeDenied {
+			failed++
+		}
+	}
+
+	if failed == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%d of %d invocations failed for topic %s", failed, len(responses), topic)
+}
+
+// begin registers an invocation with the controller, which must be ended
+// with c.inFlight.Done(), unless the controller has been shut down.
+func (c *controller) begin() error {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	if c.shutdown {
+		return ErrControllerShutdown
+	}
+
+	c.inFlight.Add(1)
+	return nil
+}
+
+// Shutdown stops the map builder and refuses any new invocations, then
+// waits for in-flight invocations to complete, for their responses to be
+// delivered to subscribers and for any sync in progress to finish before
+// releasing idle connections. If ctx is done first, Shutdown returns its
+// error and the remaining work completes in the background.
+func (c *controller) Shutdown(ctx context.Context) error {
+	c.stateLock.Lock()
+	if c.shutdown {
+		c.stateLock.Unlock()
+		return ErrControllerShutdown
+	}
+	c.shutdown = true
+	close(c.stop)
+	c.stateLock.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		c.inFlight.Wait()
+		close(c.done)
+		<-c.dispatched
+		c.mapBuilder.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	c.Invoker.Client.CloseIdleConnections()
+	if c.lookupBuilder != nil {
+		c.lookupBuilder.Client.CloseIdleConnections()
+	}
+
+	return nil
 }
 
 // BeginMapBuilder begins to build a map of function->topic by
-// querying the API gateway.
+// querying the API gateway, or from ControllerConfig.FunctionSource.
 func (c *controller) BeginMapBuilder() {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	if c.shutdown {
+		return
+	}
 
-	lookupBuilder := NewFunctionLookupBuilder(c.Config.GatewayURL, c.Config.TopicAnnotationDelimiter, MakeClient(c.Config.UpstreamTimeout), c.Credentials)
+	source := c.Config.FunctionSource
+	if source == nil {
+		c.lookupBuilder = NewFunctionLookupBuilder(c.Config.GatewayURL, c.Config.TopicAnnotationDelimiter, listClient(c.Config), c.Credentials)
+		c.lookupBuilder.Concurrency = c.Config.NamespaceConcurrency
+		c.lookupBuilder.TopicAnnotations = c.Config.TopicAnnotations
+		c.lookupBuilder.TopicLabelFallback = c.Config.TopicLabelFallback
+		c.lookupBuilder.Namespaces = c.Config.Namespaces
+		c.lookupBuilder.ExcludeNamespaces = c.Config.ExcludeNamespaces
+		c.lookupBuilder.Selector = c.Config.FunctionSelector
+		if c.restored != nil {
+			c.lookupBuilder.seed(c.restored.Functions)
+		}
+		source = c.lookupBuilder
+	}
 
-	ticker := time.NewTicker(c.Config.RebuildInterval)
-	go c.synchronizeLookups(ticker, lookupBuilder, c.TopicMap)
+	c.mapBuilder.Add(1)
+	go func() {
+		defer c.mapBuilder.Done()
+		c.synchronizeLookups(source, c.TopicMap)
+	}()
 }
 
-func (c *controller) synchronizeLookups(ticker *time.Ticker,
-	lookupBuilder *FunctionLookupBuilder,
+// synchronizeLookups syncs the topic map every RebuildInterval, and
+// whenever a FunctionSourceWatcher reports a change, until the controller
+// is shut down. A failed sync keeps the last known good map and is retried
+// with backoff.
+func (c *controller) synchronizeLookups(source FunctionSource,
 	topicMap *TopicMap) {
 
-	fn := func() {
-		lookups, err := lookupBuilder.Build()
-		if err != nil {
-			log.Fatalln(err)
+	var changes <-chan struct{}
+	if watcher, ok := source.(FunctionSourceWatcher); ok {
+		changes = watcher.Watch(c.stop)
+	}
+
+	for {
+		delay := c.Config.RebuildInterval
+		if failures := c.syncLookups(source, topicMap); failures > 0 {
+			delay = syncBackoff(c.Config.SyncBackoff, c.Config.RebuildInterval, failures)
+			c.syncFailed(delay)
 		}
 
-		if c.Config.PrintSync {
-			log.Println("Syncing topic map")
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-changes:
+			timer.Stop()
+		case <-c.stop:
+			timer.Stop()
+			return
 		}
+	}
+}
 
-		topicMap.Sync(&lookups)
+// syncLookups builds and syncs the topic map once, recording the outcome
+// in the sync status. It returns the number of consecutive failures. When
+// only some namespaces fail, the map is still synced, since it keeps their
+// last known entries, but the sync counts as a failure.
+func (c *controller) syncLookups(source FunctionSource, topicMap *TopicMap) int {
+	lookups, err := source.Build()
+
+	// a *BuildError still returns a usable map, it only counts as a
+	// failure if namespaces could not be listed
+	var buildErr *BuildError
+	partial := errors.As(err, &buildErr)
+	failed := (err != nil && !partial) || (partial && len(buildErr.Namespaces) > 0)
+
+	// The status is updated first, so that the lock is not held while
+	// listeners are notified or the snapshot is written
+	c.syncLock.Lock()
+	c.syncStatus.LastAttempt = time.Now()
+	c.syncStatus.LastError = err
+	if failed {
+		c.syncStatus.ConsecutiveFailures++
+	} else {
+		c.syncStatus.LastSuccess = c.syncStatus.LastAttempt
+		c.syncStatus.ConsecutiveFailures = 0
+		c.syncStatus.Stale = false
 	}
+	failures := c.syncStatus.ConsecutiveFailures
+	c.syncLock.Unlock()
 
-	fn()
-	for {
-		<-ticker.C
-		fn()
+	if err != nil && !partial {
+		log.Printf("[connector] unable to sync topic map, keeping last known map, error: %s", err)
+		return failures
+	}
+
+	if c.Config.PrintSync {
+		log.Println("Syncing topic map")
+	}
+
+	var functions map[string]FunctionMetadata
+	if metadata, ok := source.(FunctionMetadataSource); ok {
+		functions = metadata.Functions()
+	}
+
+	topicMap.SyncFunctions(&lookups, functions)
+	c.markReady()
+
+	if len(c.Config.SnapshotPath) > 0 {
+		if err := WriteTopicMapSnapshot(c.Config.SnapshotPath, topicMap.Snapshot()); err != nil {
+			log.Printf("[connector] unable to write topic map snapshot: %s, error: %s", c.Config.SnapshotPath, err)
+		}
 	}
+
+	if failed {
+		log.Printf("[connector] synced topic map, keeping last known functions for failed namespaces, error: %s", err)
+	} else if partial {
+		log.Printf("[connector] synced topic map, skipping malformed topics, error: %s", err)
+	}
+
+	return failures
+}
+
+// restoreSnapshot restores the topic map from ControllerConfig.SnapshotPath,
+// if it exists, and marks it as stale until a sync succeeds.
+func (c *controller) restoreSnapshot() {
+	snapshot, err := ReadTopicMapSnapshot(c.Config.SnapshotPath)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Printf("[connector] unable to restore topic map snapshot, error: %s", err)
+		return
+	}
+
+	c.TopicMap.Restore(snapshot)
+	c.restored = &snapshot
+	c.markReady()
+
+	c.syncLock.Lock()
+	c.syncStatus.Stale = true
+	c.syncLock.Unlock()
+
+	log.Printf("[connector] restored topic map generation %d synced at %s from: %s",
+		snapshot.Generation, snapshot.SyncedAt.Format(time.RFC3339), c.Config.SnapshotPath)
+}
+
+// syncFailed passes the latest sync failure to each subscriber which
+// implements SyncSubscriber.
+func (c *controller) syncFailed(retryIn time.Duration) {
+	status := c.SyncStatus()
+	failure := SyncFailure{
+		Error:               status.LastError,
+		ConsecutiveFailures: status.ConsecutiveFailures,
+		LastSuccess:         status.LastSuccess,
+		RetryAt:             status.LastAttempt.Add(retryIn),
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	for _, sub := range c.Subscribers {
+		if ss, ok := sub.(SyncSubscriber); ok {
+			ss.SyncFailed(failure)
+		}
+	}
+}
+
+// SyncStatus reports the health of the topic map sync started by
+// BeginMapBuilder.
+func (c *controller) SyncStatus() SyncStatus {
+	c.syncLock.Lock()
+	defer c.syncLock.Unlock()
+
+	status := c.syncStatus
+	status.Generation = c.TopicMap.Generation()
+	return status
 }
 
 // Topics gets the list of topics that functions have indicated should
@@ -152,6 +579,45 @@ func (c *controller) Topics() []string {
 	return c.TopicMap.Topics()
 }
 
+// baseClient makes a client for the gateway with the configured
+// RoundTripper, or a transport with the Transport and TLS options.
+func baseClient(config *ControllerConfig) *http.Client {
+	if config.RoundTripper != nil {
+		return &http.Client{
+			Transport: config.RoundTripper,
+			Timeout:   config.UpstreamTimeout,
+		}
+	}
+
+	client := MakeClientWithTransport(config.UpstreamTimeout, config.Transport)
+	if config.TLS != nil {
+		client.Transport.(*http.Transport).TLSClientConfig = config.TLS.ClientConfig()
+	}
+
+	return client
+}
+
+// gatewayClient makes a client for the gateway which applies the
+// configured Authenticator, if any.
+func gatewayClient(config *ControllerConfig) *http.Client {
+	client := baseClient(config)
+	if config.Authenticator != nil {
+		client = AuthenticatedClient(client, config.Authenticator)
+	}
+
+	return client
+}
+
+// listClient makes a client for listing functions, which applies the
+// ListAuthenticator in place of the Authenticator, if set.
+func listClient(config *ControllerConfig) *http.Client {
+	if config.ListAuthenticator != nil {
+		return AuthenticatedClient(baseClient(config), config.ListAuthenticator)
+	}
+
+	return gatewayClient(config)
+}
+
 func gatewayRoute(config *ControllerConfig) string {
 	if config.AsyncFunctionInvocation {
 		return fmt.Sprintf("%s/%s", config.GatewayURL, "async-function")
@@ -1,7 +1,10 @@
 // ControllerConfig configures a connector SDK controller
 package types
 
-import "time"
+import (
+	"net/http"
+	"time"
+)
 
 type ControllerConfig struct {
 	// UpstreamTimeout controls maximum timeout for a function invocation, which is done via the gateway
@@ -25,6 +28,15 @@ type ControllerConfig struct {
 	// TopicAnnotationDelimiter defines the character upon which to split the Topic annotation value
 	TopicAnnotationDelimiter string
 
+	// TopicAnnotations are the annotation keys which list the topics of a function, i.e. "kafka-topic". Values are either
+	// split by TopicAnnotationDelimiter or given as a JSON array.
+	// Optional, if not set DefaultTopicAnnotation is used.
+	TopicAnnotations []string
+
+	// TopicLabelFallback reads the topics of a function from labels with the same keys as TopicAnnotations when it
+	// has none of the annotations.
+	TopicLabelFallback bool
+
 	// AsyncFunctionInvocation if true points to the asynchronous function route
 	AsyncFunctionInvocation bool
 
@@ -38,7 +50,109 @@ type ControllerConfig struct {
 	// BasicAuth whether basic auth is enabled or disabled
 	BasicAuth bool
 
+	// Authenticator adds credentials to every request to the gateway, both to list functions and to invoke them,
+	// for instance a BearerAuthenticator with a ClientCredentialsTokenSource for OIDC.
+	// Optional, if not set the credentials passed to NewController are only used to list functions.
+	Authenticator Authenticator
+
+	// Transport tunes the connections to the gateway, such as idle connection limits, timeouts and HTTP/2.
+	// Optional, zero values keep the defaults of MakeClient.
+	Transport TransportConfig
+
+	// RoundTripper sends the requests to the gateway, both to list and to invoke functions, in place of the
+	// transport made from Transport and TLS, which are then ignored. The Authenticator is still applied.
+	// Optional, if not set a transport is made by MakeClientWithTransport.
+	RoundTripper http.RoundTripper
+
+	// TLS configures the CA bundle, client certificate and other TLS options for connections to the gateway,
+	// both to list and to invoke functions.
+	// Optional, if not set the system's CAs are trusted and no client certificate is presented.
+	TLS *TLSConfig
+
+	// ListAuthenticator adds credentials only to the requests which list functions, so that the gateway's admin
+	// credentials are not passed on to functions, for instance FileCredentials to reload them when they change.
+	// Optional, if not set the Authenticator or the credentials passed to NewController are used.
+	ListAuthenticator Authenticator
+
 	// UserAgent defines the user agent to be used in the request to invoke the function, it should be of the format:
 	// company/NAME-connector
 	UserAgent string
+
+	// MaxConcurrentInvocations limits the number of function invocations in flight across all topics.
+	// Optional, if not set invocations are only limited by TopicConcurrency.
+	MaxConcurrentInvocations int
+
+	// TopicConcurrency defines how many of the functions matched by a single message are invoked in parallel.
+	// Optional, if not set the functions are invoked one after another.
+	TopicConcurrency int
+
+	// RetryPolicy retries function invocations which fail at the network level or with a retryable status code.
+	// Optional, if not set each function is invoked once.
+	RetryPolicy *RetryPolicy
+
+	// CircuitBreaker stops invoking a function after consecutive failures until it recovers.
+	// Optional, if not set every matched function is always invoked.
+	CircuitBreaker *CircuitBreakerConfig
+
+	// Middleware wraps each request to a function, i.e. to add headers, sign requests or log responses. The first
+	// is the outermost, and more can be added with Controller.Use.
+	// Optional.
+	Middleware []Middleware
+
+	// InvocationPolicy decides whether a topic may invoke each function it matches, for instance a RulePolicy.
+	// Denied invocations are reported to subscribers with OutcomeDenied, and are not dead-lettered.
+	// Optional, if not set every matched function is invoked.
+	InvocationPolicy InvocationPolicy
+
+	// DeadLetterSink stores messages whose invocation finally failed so that they can be re-driven later.
+	// Optional, if not set failed messages are only reported to subscribers.
+	DeadLetterSink DeadLetterSink
+
+	// MaxResponseBodyBytes limits how much of each function's response body is read into InvokerResponse.Body.
+	// Optional, if not set the whole body is read.
+	MaxResponseBodyBytes int64
+
+	// FunctionSource builds the topic map, for instance from a file with NewFileFunctionSource or
+	// NewWatchedFileFunctionSource.
+	// Optional, if not set the functions deployed to the gateway are listed.
+	FunctionSource FunctionSource
+
+	// SnapshotPath is a file the topic map is written to after each sync, and restored from when the controller is
+	// created, so that messages can be routed before the first sync succeeds. SyncStatus reports a restored map as stale.
+	// Optional, if not set the topic map is empty until the first sync.
+	SnapshotPath string
+
+	// ReadinessPolicy decides what happens to messages published before the topic map is first synced or restored.
+	// Optional, if not set they are invoked straight away and only match functions once the map is synced.
+	ReadinessPolicy ReadinessPolicy
+
+	// ReadinessTimeout is how long ReadinessBlock waits for the controller to be ready.
+	// Optional, if not set it waits until the context of the message is done.
+	ReadinessTimeout time.Duration
+
+	// ReadinessBufferSize is the number of messages ReadinessBuffer holds until the controller is ready.
+	// Optional, if not set no messages are buffered.
+	ReadinessBufferSize int
+
+	// Namespaces are the namespaces functions are discovered in, given as path.Match patterns such as "team-*".
+	// Optional, if not set functions are discovered in every namespace.
+	Namespaces []string
+
+	// ExcludeNamespaces are namespaces, given as path.Match patterns, in which functions are never discovered.
+	// Optional.
+	ExcludeNamespaces []string
+
+	// FunctionSelector is a label selector such as "team=payments,tier!=canary" which functions must match to be
+	// discovered, see ParseLabelSelector.
+	// Optional, if not set every function with a topic annotation is discovered.
+	FunctionSelector string
+
+	// NamespaceConcurrency defines how many namespaces are listed in parallel when the topic map is rebuilt.
+	// Optional, if not set the namespaces are listed one after another.
+	NamespaceConcurrency int
+
+	// SyncBackoff is the delay before retrying a failed sync of the topic map, doubled for each consecutive
+	// failure up to RebuildInterval.
+	// Optional, if not set DefaultSyncBackoff is used.
+	SyncBackoff time.Duration
 }
@@ -0,0 +1,424 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/openfaas/faas-provider/types"
+)
+
+func Test_InvokeAndWait(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/function/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	c := NewController(nil, &ControllerConfig{
+		GatewayURL:       srv.URL,
+		UpstreamTimeout:  time.Second,
+		TopicConcurrency: 2,
+	})
+
+	lookup := map[string][]string{
+		"topic1": {"echo", "broken"},
+		"topic2": {"echo"},
+	}
+	c.(*controller).TopicMap.Sync(&lookup)
+
+	var TestCases = []struct {
+		Name          string
+		Topic         string
+		ExpectedError bool
+		Expected      []int
+	}{
+		{Name: "All succeeded", Topic: "topic2", Expected: []int{http.StatusAccepted}},
+		{Name: "One failed", Topic: "topic1", ExpectedError: true, Expected: []int{http.StatusAccepted, http.StatusInternalServerError}},
+		{Name: "No functions matched", Topic: "topic3", Expected: []int{}},
+	}
+
+	for _, test := range TestCases {
+		t.Run(test.Name, func(t *testing.T) {
+			body := []byte("hello")
+			responses, err := c.InvokeAndWait(context.Background(), test.Topic, &body, http.Header{})
+
+			if (err != nil) != test.ExpectedError {
+				t.Errorf("Error - want error: %t, got: %v", test.ExpectedError, err)
+			}
+
+			if len(responses) != len(test.Expected) {
+				t.Fatalf("Responses - want: %d, got: %d", len(test.Expected), len(responses))
+			}
+			for i, res := range responses {
+				if res.Status != test.Expected[i] {
+					t.Errorf("Response %d - want: %d, got: %d", i, test.Expected[i], res.Status)
+				}
+			}
+		})
+	}
+}
+
+func Test_Publish_AcksAndNacks(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/function/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	c := NewController(nil, &ControllerConfig{
+		GatewayURL:      srv.URL,
+		UpstreamTimeout: time.Second,
+	})
+
+	lookup := map[string][]string{
+		"topic1": {"echo"},
+		"topic2": {"echo", "broken"},
+	}
+	c.(*controller).TopicMap.Sync(&lookup)
+
+	var TestCases = []struct {
+		Name         string
+		Topic        string
+		ExpectedAck  bool
+		ExpectedNack bool
+	}{
+		{Name: "Acked", Topic: "topic1", ExpectedAck: true},
+		{Name: "Nacked", Topic: "topic2", ExpectedNack: true},
+	}
+
+	for _, test := range TestCases {
+		t.Run(test.Name, func(t *testing.T) {
+			acked, nacked := false, false
+
+			err := c.Publish(context.Background(), Message{
+				Topic: test.Topic,
+				ID:    "1",
+				Body:  []byte("hello"),
+				Ack: func() error {
+					acked = true
+					return nil
+				},
+				Nack: func(error) error {
+					nacked = true
+					return nil
+				},
+			})
+
+			if (err != nil) != test.ExpectedNack {
+				t.Errorf("Error - want error: %t, got: %v", test.ExpectedNack, err)
+			}
+			if acked != test.ExpectedAck || nacked != test.ExpectedNack {
+				t.Errorf("Ack/Nack - want: %t/%t, got: %t/%t", test.ExpectedAck, test.ExpectedNack, acked, nacked)
+			}
+		})
+	}
+}
+
+func Test_Shutdown_DrainsInFlightInvocations(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	c := NewController(nil, &ControllerConfig{
+		GatewayURL:      srv.URL,
+		UpstreamTimeout: time.Second,
+	})
+
+	lookup := map[string][]string{"topic1": {"echo"}}
+	c.(*controller).TopicMap.Sync(&lookup)
+
+	delivered := make(chan InvokerResponse, 1)
+	c.Subscribe(subscriberFunc(func(res InvokerResponse) {
+		delivered <- res
+	}))
+
+	published := make(chan error)
+	go func() {
+		published <- c.Publish(context.Background(), Message{Topic: "topic1", Body: []byte("hello")})
+	}()
+
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown with invocation in flight - want: %s, got: %v", context.DeadlineExceeded, err)
+	}
+
+	if err := c.Publish(context.Background(), Message{Topic: "topic1", Body: []byte("hello")}); err != ErrControllerShutdown {
+		t.Errorf("Publish after Shutdown - want: %s, got: %v", ErrControllerShutdown, err)
+	}
+
+	close(release)
+
+	if err := <-published; err != nil {
+		t.Errorf("In-flight Publish - want: no error, got: %s", err)
+	}
+
+	select {
+	case res := <-delivered:
+		if res.Status != http.StatusOK {
+			t.Errorf("Delivered response - want: %d, got: %d", http.StatusOK, res.Status)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("In-flight response was not delivered to subscriber")
+	}
+}
+
+func Test_Shutdown_WaitsForSync(t *testing.T) {
+	source := &blockingSource{
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+
+	c := NewController(nil, &ControllerConfig{
+		GatewayURL:      "http://127.0.0.1:8080",
+		UpstreamTimeout: time.Second,
+		RebuildInterval: time.Minute,
+		FunctionSource:  source,
+	}).(*controller)
+
+	c.BeginMapBuilder()
+	<-source.started
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- c.Shutdown(context.Background())
+	}()
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown with sync in progress - want: blocked, got: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(source.release)
+
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown - want: no error, got: %s", err)
+	}
+	if got := c.TopicMap.Generation(); got != 1 {
+		t.Errorf("Generation after Shutdown - want: %d, got: %d", 1, got)
+	}
+}
+
+func Test_SyncLookups_KeepsLastKnownMap(t *testing.T) {
+	var healthy int32 = 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusBadGateway)
+			_, _ = w.Write([]byte("upstream unavailable"))
+			return
+		}
+
+		if r.URL.Path == "/system/namespaces" {
+			bytesOut, _ := json.Marshal([]string{"openfaas-fn"})
+			_, _ = w.Write(bytesOut)
+			return
+		}
+
+		functions := []types.FunctionStatus{{
+			Name:        "echo",
+			Annotations: &map[string]string{"topic": "topic1"},
+		}}
+		bytesOut, _ := json.Marshal(functions)
+		_, _ = w.Write(bytesOut)
+	}))
+	defer srv.Close()
+
+	c := NewController(nil, &ControllerConfig{
+		GatewayURL:      srv.URL,
+		UpstreamTimeout: time.Second,
+		RebuildInterval: time.Minute,
+	}).(*controller)
+
+	builder := NewFunctionLookupBuilder(srv.URL, ",", srv.Client(), nil)
+
+	if failures := c.syncLookups(builder, c.TopicMap); failures != 0 {
+		t.Fatalf("Failures after successful sync - want: %d, got: %d", 0, failures)
+	}
+	lastSuccess := c.SyncStatus().LastSuccess
+	if lastSuccess.IsZero() {
+		t.Errorf("LastSuccess - want: set, got: zero")
+	}
+
+	atomic.StoreInt32(&healthy, 0)
+
+	for want := 1; want <= 2; want++ {
+		if failures := c.syncLookups(builder, c.TopicMap); failures != want {
+			t.Errorf("Failures - want: %d, got: %d", want, failures)
+		}
+	}
+
+	status := c.SyncStatus()
+	if status.ConsecutiveFailures != 2 {
+		t.Errorf("ConsecutiveFailures - want: %d, got: %d", 2, status.ConsecutiveFailures)
+	}
+	if status.LastError == nil {
+		t.Errorf("LastError - want: error, got: nil")
+	}
+	if !status.LastSuccess.Equal(lastSuccess) {
+		t.Errorf("LastSuccess - want: %s, got: %s", lastSuccess, status.LastSuccess)
+	}
+	if got := c.TopicMap.Match("topic1"); len(got) != 1 || got[0] != "echo.openfaas-fn" {
+		t.Errorf("Last known map - want: %v, got: %v", []string{"echo.openfaas-fn"}, got)
+	}
+
+	atomic.StoreInt32(&healthy, 1)
+
+	c.syncLookups(builder, c.TopicMap)
+	status = c.SyncStatus()
+	if status.ConsecutiveFailures != 0 || status.LastError != nil {
+		t.Errorf("Status after recovery - want: %d failures and no error, got: %d, %v", 0, status.ConsecutiveFailures, status.LastError)
+	}
+}
+
+func Test_SynchronizeLookups_NotifiesSyncSubscribers(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	c := NewController(nil, &ControllerConfig{
+		GatewayURL:      srv.URL,
+		UpstreamTimeout: time.Second,
+		RebuildInterval: time.Minute,
+		SyncBackoff:     time.Millisecond,
+	})
+
+	failures := make(chan SyncFailure, 10)
+	c.Subscribe(&syncSubscriber{failures: failures})
+
+	c.BeginMapBuilder()
+	defer c.Shutdown(context.Background())
+
+	for want := 1; want <= 2; want++ {
+		select {
+		case failure := <-failures:
+			if failure.ConsecutiveFailures != want {
+				t.Errorf("ConsecutiveFailures - want: %d, got: %d", want, failure.ConsecutiveFailures)
+			}
+			if failure.Error == nil {
+				t.Errorf("Error - want: error, got: nil")
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Sync failure %d was not delivered to subscriber", want)
+		}
+	}
+}
+
+func Test_SyncLookups_ListenerReadsSyncStatus(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "topics.yaml")
+	if err := os.WriteFile(path, []byte("topic1:\n- echo\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewController(nil, &ControllerConfig{
+		GatewayURL:      "http://127.0.0.1:8080",
+		UpstreamTimeout: time.Second,
+	}).(*controller)
+
+	statuses := make(chan SyncStatus, 1)
+	c.Subscribe(&statusListener{controller: c, statuses: statuses})
+
+	done := make(chan struct{})
+	go func() {
+		c.syncLookups(NewFileFunctionSource(path), c.TopicMap)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Sync - want: done, got: blocked by a listener reading SyncStatus")
+	}
+
+	status := <-statuses
+	if status.LastSuccess.IsZero() || status.ConsecutiveFailures != 0 {
+		t.Errorf("Status in listener - want: synced, got: %+v", status)
+	}
+}
+
+func Test_SyncBackoff(t *testing.T) {
+	var TestCases = []struct {
+		Name     string
+		Base     time.Duration
+		Failures int
+		Min      time.Duration
+		Max      time.Duration
+	}{
+		{Name: "Default base", Failures: 1, Min: 800 * time.Millisecond, Max: 1200 * time.Millisecond},
+		{Name: "Doubled", Base: 10 * time.Second, Failures: 3, Min: 32 * time.Second, Max: 48 * time.Second},
+		{Name: "Capped at rebuild interval", Base: 10 * time.Second, Failures: 10, Min: time.Minute, Max: time.Minute},
+	}
+
+	for _, test := range TestCases {
+		t.Run(test.Name, func(t *testing.T) {
+			got := syncBackoff(test.Base, time.Minute, test.Failures)
+			if got < test.Min || got > test.Max {
+				t.Errorf("Backoff - want: between %s and %s, got: %s", test.Min, test.Max, got)
+			}
+		})
+	}
+}
+
+type syncSubscriber struct {
+	failures chan SyncFailure
+}
+
+func (s *syncSubscriber) Response(InvokerResponse) {}
+
+func (s *syncSubscriber) SyncFailed(failure SyncFailure) {
+	s.failures <- failure
+}
+
+type subscriberFunc func(InvokerResponse)
+
+func (f subscriberFunc) Response(res InvokerResponse) {
+	f(res)
+}
+
+// blockingSource signals each Build on started, then waits for release
+type blockingSource struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingSource) Build() (map[string][]string, error) {
+	s.started <- struct{}{}
+	<-s.release
+	return map[string][]string{"topic1": {"echo"}}, nil
+}
+
+// statusListener reads the sync status when the topic map changes
+type statusListener struct {
+	controller *controller
+	statuses   chan SyncStatus
+}
+
+func (l *statusListener) Response(InvokerResponse) {}
+
+func (l *statusListener) TopicMapChanged(TopicMapDiff) {
+	l.statuses <- l.controller.SyncStatus()
+}
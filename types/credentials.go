@@ -4,29 +4,170 @@
 package types
 
 import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/openfaas/faas-provider/auth"
 )
 
+// GetCredentials reads the basic auth credentials when the basic_auth
+// environment variable is set.
+//
+// Deprecated: GetCredentials panics if the credentials cannot be read, use
+// ReadCredentials, or NewFileCredentials to reload them when they change.
 func GetCredentials() *auth.BasicAuthCredentials {
-	var credentials *auth.BasicAuthCredentials
+	credentials, err := ReadCredentials()
+	if err != nil {
+		panic(err)
+	}
+	return credentials
+}
 
-	if val, ok := os.LookupEnv("basic_auth"); ok && len(val) > 0 {
-		if val == "true" || val == "1" {
+// ReadCredentials reads the basic auth credentials from the
+// secret_mount_path when the basic_auth environment variable is "true" or
+// "1", otherwise it returns nil.
+func ReadCredentials() (*auth.BasicAuthCredentials, error) {
+	if val, ok := os.LookupEnv("basic_auth"); !ok || (val != "true" && val != "1") {
+		return nil, nil
+	}
 
-			reader := auth.ReadBasicAuthFromDisk{}
+	reader := auth.ReadBasicAuthFromDisk{
+		SecretMountPath: os.Getenv("secret_mount_path"),
+	}
 
-			if val, ok := os.LookupEnv("secret_mount_path"); ok && len(val) > 0 {
-				reader.SecretMountPath = os.Getenv("secret_mount_path")
-			}
+	credentials, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read basic auth credentials, error: %w", err)
+	}
+
+	return credentials, nil
+}
+
+// RefreshingAuthenticator can be implemented by an Authenticator whose
+// credentials may be out of date. Refresh is called when the gateway
+// responds with 401 Unauthorized, and the request is retried once with the
+// new credentials if it returns true.
+type RefreshingAuthenticator interface {
+	Authenticator
+
+	// Refresh reloads the credentials, returning true if they changed
+	Refresh(ctx context.Context) (bool, error)
+}
+
+// DefaultCredentialsInterval is how often FileCredentials are re-read from
+// disk when no interval is given.
+const DefaultCredentialsInterval = 10 * time.Second
+
+// FileCredentials is an Authenticator for the basic auth credentials in
+// the basic-auth-user and basic-auth-password files of a secret mount
+// path. The credentials are re-read every Interval once the controller
+// starts, and immediately when the gateway responds with 401
+// Unauthorized, so that a rotated password is picked up without a
+// restart. If the files cannot be read the last credentials are kept.
+type FileCredentials struct {
+	SecretMountPath string
+	Interval        time.Duration
+
+	credentials *auth.BasicAuthCredentials
+	lock        sync.RWMutex
+}
+
+// NewFileCredentials reads the credentials in secretMountPath, returning an
+// error if they cannot be read. If interval is zero,
+// DefaultCredentialsInterval is used.
+func NewFileCredentials(secretMountPath string, interval time.Duration) (*FileCredentials, error) {
+	if interval <= 0 {
+		interval = DefaultCredentialsInterval
+	}
+
+	f := &FileCredentials{
+		SecretMountPath: secretMountPath,
+		Interval:        interval,
+	}
+
+	if _, err := f.Reload(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
 
-			res, err := reader.Read()
-			if err != nil {
-				panic(err)
+// Credentials returns the current credentials
+func (f *FileCredentials) Credentials() *auth.BasicAuthCredentials {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	return f.credentials
+}
+
+// Reload re-reads the credentials from disk and swaps them in, returning
+// true if they changed. On error the last credentials are kept.
+func (f *FileCredentials) Reload() (bool, error) {
+	reader := auth.ReadBasicAuthFromDisk{
+		SecretMountPath: f.SecretMountPath,
+	}
+
+	credentials, err := reader.Read()
+	if err != nil {
+		return false, fmt.Errorf("unable to read basic auth credentials, error: %w", err)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.credentials != nil && *f.credentials == *credentials {
+		return false, nil
+	}
+
+	f.credentials = credentials
+	return true, nil
+}
+
+// Authenticate implements Authenticator
+func (f *FileCredentials) Authenticate(req *http.Request) error {
+	credentials := f.Credentials()
+	if credentials == nil {
+		return fmt.Errorf("no basic auth credentials loaded from %s", f.SecretMountPath)
+	}
+
+	req.SetBasicAuth(credentials.User, credentials.Password)
+	return nil
+}
+
+// Refresh implements RefreshingAuthenticator
+func (f *FileCredentials) Refresh(ctx context.Context) (bool, error) {
+	return f.Reload()
+}
+
+// Watch re-reads the credentials every Interval until stop is closed.
+// It is started by the controller for a configured Authenticator.
+func (f *FileCredentials) Watch(stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(f.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if changed, err := f.Reload(); err != nil {
+					log.Printf("[connector] %s, keeping the last credentials", err)
+				} else if changed {
+					log.Printf("[connector] Reloaded basic auth credentials from %s", f.SecretMountPath)
+				}
+			case <-stop:
+				return
 			}
-			credentials = res
 		}
-	}
-	return credentials
+	}()
+}
+
+// credentialsWatcher is implemented by an Authenticator which reloads its
+// credentials in the background, such as FileCredentials.
+type credentialsWatcher interface {
+	Watch(stop <-chan struct{})
 }
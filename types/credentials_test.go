@@ -0,0 +1,167 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func writeCredentials(t *testing.T, dir, user, password string) {
+	t.Helper()
+
+	if err := os.WriteFile(filepath.Join(dir, "basic-auth-user"), []byte(user+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "basic-auth-password"), []byte(password+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_ReadCredentials(t *testing.T) {
+	dir := t.TempDir()
+	writeCredentials(t, dir, "admin", "secret")
+
+	var TestCases = []struct {
+		Name            string
+		BasicAuth       string
+		SecretMountPath string
+		ExpectedUser    string
+		ExpectedErr     bool
+	}{
+		{
+			Name:      "Basic auth disabled",
+			BasicAuth: "false",
+		},
+		{
+			Name:            "Basic auth enabled",
+			BasicAuth:       "true",
+			SecretMountPath: dir,
+			ExpectedUser:    "admin",
+		},
+		{
+			Name:            "Missing secrets",
+			BasicAuth:       "1",
+			SecretMountPath: filepath.Join(dir, "missing"),
+			ExpectedErr:     true,
+		},
+	}
+
+	for _, test := range TestCases {
+		t.Run(test.Name, func(t *testing.T) {
+			t.Setenv("basic_auth", test.BasicAuth)
+			t.Setenv("secret_mount_path", test.SecretMountPath)
+
+			credentials, err := ReadCredentials()
+			if (err != nil) != test.ExpectedErr {
+				t.Fatalf("Error - want: %t, got: %v", test.ExpectedErr, err)
+			}
+
+			user := ""
+			if credentials != nil {
+				user = credentials.User
+			}
+			if user != test.ExpectedUser {
+				t.Errorf("User - want: %q, got: %q", test.ExpectedUser, user)
+			}
+		})
+	}
+}
+
+func Test_FileCredentials_ReloadsOnUnauthorized(t *testing.T) {
+	dir := t.TempDir()
+	writeCredentials(t, dir, "admin", "secret1")
+
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+
+		user, password, _ := r.BasicAuth()
+		body := new(bytes.Buffer)
+		_, _ = body.ReadFrom(r.Body)
+
+		if user != "admin" || password != "secret2" || body.String() != "hello" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	credentials, err := NewFileCredentials(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := AuthenticatedClient(srv.Client(), credentials)
+
+	// The password is rotated after the credentials were first read
+	writeCredentials(t, dir, "admin", "secret2")
+
+	res, err := client.Post(srv.URL, "text/plain", bytes.NewReader([]byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Status - want: %d, got: %d", http.StatusOK, res.StatusCode)
+	}
+	if got := atomic.LoadInt32(&requests); got != 2 {
+		t.Errorf("Requests - want: %d, got: %d", 2, got)
+	}
+	if got := credentials.Credentials().Password; got != "secret2" {
+		t.Errorf("Password - want: %s, got: %s", "secret2", got)
+	}
+
+	// Unchanged credentials are not retried
+	res, err = client.Post(srv.URL, "text/plain", bytes.NewReader([]byte("wrong")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if got := atomic.LoadInt32(&requests); got != 3 {
+		t.Errorf("Requests - want: %d, got: %d", 3, got)
+	}
+}
+
+func Test_FileCredentials_WatchKeepsLastOnError(t *testing.T) {
+	dir := t.TempDir()
+	writeCredentials(t, dir, "admin", "secret1")
+
+	credentials, err := NewFileCredentials(dir, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	credentials.Watch(stop)
+
+	if err := os.Remove(filepath.Join(dir, "basic-auth-password")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	if got := credentials.Credentials().Password; got != "secret1" {
+		t.Errorf("Password after error - want: %s, got: %s", "secret1", got)
+	}
+
+	writeCredentials(t, dir, "admin", "secret2")
+
+	deadline := time.Now().Add(time.Second)
+	for credentials.Credentials().Password != "secret2" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Password after rotation - want: %s, got: %s", "secret2", credentials.Credentials().Password)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
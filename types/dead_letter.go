@@ -0,0 +1,377 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// DeadLetter is a message whose invocation of a function has finally
+// failed, after any retries. Body is empty for messages which were
+// streamed with Message.BodyReader or Message.GetBody.
+type DeadLetter struct {
+	ID       string            `json:"id,omitempty"`
+	Topic    string            `json:"topic"`
+	Function string            `json:"function"`
+	Header   http.Header       `json:"header,omitempty"`
+	Body     []byte            `json:"body"`
+	Status   int               `json:"status,omitempty"`
+	Error    string            `json:"error,omitempty"`
+	Outcome  InvocationOutcome `json:"outcome"`
+	Attempts int               `json:"attempts"`
+
+	// StartedAt is when the first attempt to invoke the function was made
+	StartedAt time.Time `json:"startedAt"`
+
+	// FailedAt is when the invocation was given up on
+	FailedAt time.Time `json:"failedAt"`
+}
+
+// DeadLetterSink stores messages whose invocation has finally failed, so
+// that they can be inspected and re-driven later with RedriveDeadLetters.
+// Implementations must be safe for concurrent use.
+type DeadLetterSink interface {
+	// Write stores a dead letter
+	Write(ctx context.Context, letter DeadLetter) error
+
+	// Drain removes and returns every stored dead letter
+	Drain(ctx context.Context) ([]DeadLetter, error)
+}
+
+// DrainCommitter can be implemented by a DeadLetterSink which keeps the
+// letters returned by Drain until RedriveDeadLetters has re-driven them or
+// written them back, so that they are not lost if the process exits part
+// way through. Such letters may be re-driven a second time.
+type DrainCommitter interface {
+	// CommitDrain discards the letters returned by the last Drain
+	CommitDrain(ctx context.Context) error
+}
+
+// newDeadLetter records a failed InvokerResponse along with the message
+// which was sent to the function.
+func newDeadLetter(res InvokerResponse, msg *Message, startedAt time.Time) DeadLetter {
+	letter := DeadLetter{
+		ID:        msg.ID,
+		Topic:     res.Topic,
+		Function:  res.Function,
+		Header:    msg.Header.Clone(),
+		Body:      append([]byte{}, msg.Body...),
+		Status:    res.Status,
+		Outcome:   res.Outcome,
+		Attempts:  res.Attempts,
+		StartedAt: startedAt,
+		FailedAt:  time.Now(),
+	}
+
+	if res.Error != nil {
+		letter.Error = res.Error.Error()
+	}
+
+	return letter
+}
+
+// deadLetterRedriver is implemented by the controller to invoke the
+// function of a dead letter again.
+type deadLetterRedriver interface {
+	redrive(ctx context.Context, letter DeadLetter) (InvokerResponse, error)
+}
+
+// RedriveDeadLetters drains sink and invokes the function of each letter
+// again with its message, so functions which already succeeded are not
+// invoked a second time. Any letter which is not re-driven successfully is
+// written back to sink with the new error, as are the remaining letters if
+// ctx is done or the controller is shut down part way through. It returns
+// the number of letters re-driven successfully.
+func RedriveDeadLetters(ctx context.Context, sink DeadLetterSink, controller Controller) (int, error) {
+	redriver, ok := controller.(deadLetterRedriver)
+	if !ok {
+		return 0, fmt.Errorf("unable to re-drive dead letters with %T", controller)
+	}
+
+	letters, err := sink.Drain(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("unable to drain dead letters, error: %w", err)
+	}
+
+	redriven, handled, err := redriveLetters(ctx, sink, redriver, letters)
+	if !handled {
+		return redriven, err
+	}
+
+	if committer, ok := sink.(DrainCommitter); ok {
+		if commitErr := committer.CommitDrain(context.Background()); commitErr != nil {
+			return redriven, fmt.Errorf("unable to commit drained dead letters, error: %w", commitErr)
+		}
+	}
+
+	return redriven, err
+}
+
+// redriveLetters re-drives each letter in turn, writing back any which
+// are not re-driven successfully. handled is false if any letter could
+// not be written back.
+func redriveLetters(ctx context.Context, sink DeadLetterSink, redriver deadLetterRedriver, letters []DeadLetter) (redriven int, handled bool, err error) {
+	for i, letter := range letters {
+		if ctx.Err() != nil {
+			if err := restoreDeadLetters(sink, letters[i:]); err != nil {
+				return redriven, false, err
+			}
+			return redriven, true, ctx.Err()
+		}
+
+		res, redriveErr := redriver.redrive(ctx, letter)
+		if redriveErr == nil && res.Outcome == OutcomeSucceeded {
+			redriven++
+			continue
+		}
+
+		letter.FailedAt = time.Now()
+		if redriveErr != nil {
+			letter.Error = redriveErr.Error()
+		} else {
+			letter.Status = res.Status
+			letter.Outcome = res.Outcome
+			letter.Attempts += res.Attempts
+			letter.Error = ""
+			if res.Error != nil {
+				letter.Error = res.Error.Error()
+			}
+		}
+
+		if err := restoreDeadLetters(sink, []DeadLetter{letter}); err != nil {
+			return redriven, false, err
+		}
+
+		if errors.Is(redriveErr, ErrControllerShutdown) {
+			if err := restoreDeadLetters(sink, letters[i+1:]); err != nil {
+				return redriven, false, err
+			}
+			return redriven, true, redriveErr
+		}
+	}
+
+	return redriven, true, nil
+}
+
+// restoreDeadLetters writes letters back to sink
+func restoreDeadLetters(sink DeadLetterSink, letters []DeadLetter) error {
+	for _, letter := range letters {
+		if err := sink.Write(context.Background(), letter); err != nil {
+			return fmt.Errorf("unable to restore dead letter for %s, error: %w", letter.Function, err)
+		}
+	}
+	return nil
+}
+
+// MemoryDeadLetterSink keeps dead letters in memory, up to an optional limit
+type MemoryDeadLetterSink struct {
+	// MaxLetters is the number of letters kept before the oldest is
+	// dropped, zero means no limit.
+	MaxLetters int
+
+	letters []DeadLetter
+	lock    sync.Mutex
+}
+
+// NewMemoryDeadLetterSink creates an in-memory DeadLetterSink which keeps
+// at most maxLetters, zero means no limit.
+func NewMemoryDeadLetterSink(maxLetters int) *MemoryDeadLetterSink {
+	return &MemoryDeadLetterSink{
+		MaxLetters: maxLetters,
+	}
+}
+
+// Write stores a dead letter, dropping the oldest one if the sink is full
+func (m *MemoryDeadLetterSink) Write(ctx context.Context, letter DeadLetter) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.letters = append(m.letters, letter)
+	if m.MaxLetters > 0 && len(m.letters) > m.MaxLetters {
+		m.letters = m.letters[len(m.letters)-m.MaxLetters:]
+	}
+
+	return nil
+}
+
+// Drain removes and returns every stored dead letter
+func (m *MemoryDeadLetterSink) Drain(ctx context.Context) ([]DeadLetter, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	letters := m.letters
+	m.letters = nil
+
+	return letters, nil
+}
+
+// FileDeadLetterSink appends dead letters to a file as JSON lines. Drained
+// letters are kept in a ".draining" file next to it until they have been
+// handled, see Drain.
+type FileDeadLetterSink struct {
+	Path string
+
+	// drained is set when the letters in the draining file were returned
+	// by Drain in this process, guarded by lock
+	drained bool
+	lock    sync.Mutex
+}
+
+// NewFileDeadLetterSink creates a DeadLetterSink which appends to the file
+// at path, creating it if necessary.
+func NewFileDeadLetterSink(path string) *FileDeadLetterSink {
+	return &FileDeadLetterSink{
+		Path: path,
+	}
+}
+
+// Write appends a dead letter to the file
+func (f *FileDeadLetterSink) Write(ctx context.Context, letter DeadLetter) error {
+	line, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	file, err := os.OpenFile(f.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(line); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// Drain moves the file aside and returns every dead letter in it. The
+// letters are kept on disk until CommitDrain, or the next Drain, so that
+// letters left by a process which exited during RedriveDeadLetters are
+// returned again by its next Drain.
+func (f *FileDeadLetterSink) Drain(ctx context.Context) ([]DeadLetter, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	draining := f.drainingPath()
+
+	// The letters of the last Drain in this process belong to its caller
+	if f.drained {
+		if err := os.Remove(draining); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		f.drained = false
+	}
+
+	if err := f.moveToDraining(draining); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(draining)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	f.drained = true
+
+	var letters []DeadLetter
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var letter DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			return nil, fmt.Errorf("unable to parse line %d of %s, error: %w", line, draining, err)
+		}
+		letters = append(letters, letter)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return letters, nil
+}
+
+// CommitDrain implements DrainCommitter, removing the letters returned by
+// the last Drain from disk.
+func (f *FileDeadLetterSink) CommitDrain(ctx context.Context) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err := os.Remove(f.drainingPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f.drained = false
+
+	return nil
+}
+
+// moveToDraining renames the file to draining, or appends it to draining
+// if letters are still there from a process which exited part way through
+// a re-drive.
+func (f *FileDeadLetterSink) moveToDraining(draining string) error {
+	if _, err := os.Stat(draining); os.IsNotExist(err) {
+		if err := os.Rename(f.Path, draining); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := os.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(draining, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(f.Path)
+}
+
+func (f *FileDeadLetterSink) drainingPath() string {
+	return f.Path + ".draining"
+}
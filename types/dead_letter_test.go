@@ -0,0 +1,297 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_FileDeadLetterSink_WriteAndDrain(t *testing.T) {
+	sink := NewFileDeadLetterSink(filepath.Join(t.TempDir(), "dead-letters.jsonl"))
+
+	letters, err := sink.Drain(context.Background())
+	if err != nil {
+		t.Fatalf("Drain of missing file - want: no error, got: %s", err)
+	}
+	if len(letters) != 0 {
+		t.Fatalf("Drain of missing file - want: %d letters, got: %d", 0, len(letters))
+	}
+
+	for _, topic := range []string{"topic1", "topic2"} {
+		err := sink.Write(context.Background(), DeadLetter{
+			Topic:    topic,
+			Function: "echo.openfaas-fn",
+			Header:   http.Header{"X-Message-Id": {"1"}},
+			Body:     []byte(`{"hello": "world"}`),
+			Status:   http.StatusInternalServerError,
+		})
+		if err != nil {
+			t.Fatalf("Write - want: no error, got: %s", err)
+		}
+	}
+
+	letters, err = sink.Drain(context.Background())
+	if err != nil {
+		t.Fatalf("Drain - want: no error, got: %s", err)
+	}
+	if len(letters) != 2 {
+		t.Fatalf("Drain - want: %d letters, got: %d", 2, len(letters))
+	}
+	if letters[1].Topic != "topic2" || string(letters[1].Body) != `{"hello": "world"}` || letters[1].Header.Get("X-Message-Id") != "1" {
+		t.Errorf("Drain - unexpected letter: %+v", letters[1])
+	}
+
+	letters, _ = sink.Drain(context.Background())
+	if len(letters) != 0 {
+		t.Errorf("Drain after drain - want: %d letters, got: %d", 0, len(letters))
+	}
+}
+
+func Test_FileDeadLetterSink_KeepsDrainedLettersUntilCommitted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+
+	sink := NewFileDeadLetterSink(path)
+	for _, topic := range []string{"topic1", "topic2"} {
+		_ = sink.Write(context.Background(), DeadLetter{Topic: topic})
+	}
+
+	if letters, _ := sink.Drain(context.Background()); len(letters) != 2 {
+		t.Fatalf("Drain - want: %d letters, got: %d", 2, len(letters))
+	}
+
+	// A new process after one which exited part way through a re-drive
+	restarted := NewFileDeadLetterSink(path)
+	_ = restarted.Write(context.Background(), DeadLetter{Topic: "topic3"})
+
+	letters, err := restarted.Drain(context.Background())
+	if err != nil {
+		t.Fatalf("Drain after restart - want: no error, got: %s", err)
+	}
+
+	var topics []string
+	for _, letter := range letters {
+		topics = append(topics, letter.Topic)
+	}
+	if want := []string{"topic1", "topic2", "topic3"}; !reflect.DeepEqual(topics, want) {
+		t.Errorf("Drain after restart - want: %v, got: %v", want, topics)
+	}
+
+	if err := restarted.CommitDrain(context.Background()); err != nil {
+		t.Fatalf("CommitDrain - want: no error, got: %s", err)
+	}
+	if _, err := os.Stat(path + ".draining"); !os.IsNotExist(err) {
+		t.Errorf("Draining file after CommitDrain - want: removed, got: %v", err)
+	}
+
+	if letters, _ := NewFileDeadLetterSink(path).Drain(context.Background()); len(letters) != 0 {
+		t.Errorf("Drain after CommitDrain - want: %d letters, got: %d", 0, len(letters))
+	}
+}
+
+func Test_RedriveDeadLetters_CommitsFileSink(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/function/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	c := NewController(nil, &ControllerConfig{
+		GatewayURL:      srv.URL,
+		UpstreamTimeout: time.Second,
+	})
+
+	lookup := map[string][]string{"topic1": {"echo", "broken"}}
+	c.(*controller).TopicMap.Sync(&lookup)
+
+	path := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	sink := NewFileDeadLetterSink(path)
+	for _, function := range []string{"echo", "broken"} {
+		_ = sink.Write(context.Background(), DeadLetter{Topic: "topic1", Function: function, Body: []byte("hello")})
+	}
+
+	n, err := RedriveDeadLetters(context.Background(), sink, c)
+	if err != nil {
+		t.Fatalf("RedriveDeadLetters - want: no error, got: %s", err)
+	}
+	if n != 1 {
+		t.Errorf("RedriveDeadLetters - want: %d re-driven, got: %d", 1, n)
+	}
+
+	if _, err := os.Stat(path + ".draining"); !os.IsNotExist(err) {
+		t.Errorf("Draining file after re-drive - want: removed, got: %v", err)
+	}
+
+	letters, _ := NewFileDeadLetterSink(path).Drain(context.Background())
+	if len(letters) != 1 || letters[0].Function != "broken" {
+		t.Errorf("Dead letters after re-drive - want: [broken], got: %+v", letters)
+	}
+}
+
+func Test_MemoryDeadLetterSink_MaxLetters(t *testing.T) {
+	sink := NewMemoryDeadLetterSink(2)
+
+	for _, topic := range []string{"topic1", "topic2", "topic3"} {
+		_ = sink.Write(context.Background(), DeadLetter{Topic: topic})
+	}
+
+	letters, _ := sink.Drain(context.Background())
+	if len(letters) != 2 || letters[0].Topic != "topic2" {
+		t.Errorf("Drain - want: [topic2 topic3], got: %+v", letters)
+	}
+}
+
+func Test_DeadLetters_WrittenAndRedriven(t *testing.T) {
+	var failing int32 = 1
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	sink := NewMemoryDeadLetterSink(0)
+	c := NewController(nil, &ControllerConfig{
+		GatewayURL:      srv.URL,
+		UpstreamTimeout: time.Second,
+		DeadLetterSink:  sink,
+	})
+
+	lookup := map[string][]string{"topic1": {"echo"}}
+	c.(*controller).TopicMap.Sync(&lookup)
+
+	body := []byte("hello")
+	c.Invoke("topic1", &body, http.Header{"X-Message-Id": {"1"}})
+
+	letters, _ := sink.Drain(context.Background())
+	if len(letters) != 1 {
+		t.Fatalf("Dead letters - want: %d, got: %d", 1, len(letters))
+	}
+	if letters[0].Function != "echo" || letters[0].Status != http.StatusInternalServerError || letters[0].Outcome != OutcomeFailed {
+		t.Errorf("Dead letter - unexpected: %+v", letters[0])
+	}
+
+	for _, letter := range letters {
+		_ = sink.Write(context.Background(), letter)
+	}
+
+	atomic.StoreInt32(&failing, 0)
+
+	n, err := RedriveDeadLetters(context.Background(), sink, c)
+	if err != nil {
+		t.Fatalf("RedriveDeadLetters - want: no error, got: %s", err)
+	}
+	if n != 1 {
+		t.Errorf("RedriveDeadLetters - want: %d re-driven, got: %d", 1, n)
+	}
+
+	letters, _ = sink.Drain(context.Background())
+	if len(letters) != 0 {
+		t.Errorf("Dead letters after re-drive - want: %d, got: %d", 0, len(letters))
+	}
+}
+
+func Test_RedriveDeadLetters_OnlyFailedFunctions(t *testing.T) {
+	var mutex sync.Mutex
+	invocations := map[string]int{}
+	var failing int32 = 1
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		invocations[r.URL.Path]++
+		mutex.Unlock()
+
+		if r.URL.Path != "/function/good" && atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	sink := NewMemoryDeadLetterSink(0)
+	c := NewController(nil, &ControllerConfig{
+		GatewayURL:      srv.URL,
+		UpstreamTimeout: time.Second,
+		DeadLetterSink:  sink,
+	})
+
+	lookup := map[string][]string{"topic1": {"good", "bad1", "bad2"}}
+	c.(*controller).TopicMap.Sync(&lookup)
+
+	body := []byte("hello")
+	c.Invoke("topic1", &body, http.Header{})
+
+	atomic.StoreInt32(&failing, 0)
+
+	n, err := RedriveDeadLetters(context.Background(), sink, c)
+	if err != nil {
+		t.Fatalf("RedriveDeadLetters - want: no error, got: %s", err)
+	}
+	if n != 2 {
+		t.Errorf("RedriveDeadLetters - want: %d re-driven, got: %d", 2, n)
+	}
+
+	want := map[string]int{"/function/good": 1, "/function/bad1": 2, "/function/bad2": 2}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !reflect.DeepEqual(invocations, want) {
+		t.Errorf("Invocations - want: %v, got: %v", want, invocations)
+	}
+}
+
+func Test_RedriveDeadLetters_KeepsLettersAfterShutdown(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	c := NewController(nil, &ControllerConfig{
+		GatewayURL:      srv.URL,
+		UpstreamTimeout: time.Second,
+	})
+
+	lookup := map[string][]string{"topic1": {"echo"}}
+	c.(*controller).TopicMap.Sync(&lookup)
+
+	if err := c.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	sink := NewMemoryDeadLetterSink(0)
+	for _, id := range []string{"1", "2"} {
+		_ = sink.Write(context.Background(), DeadLetter{ID: id, Topic: "topic1", Function: "echo", Body: []byte("hello")})
+	}
+
+	n, err := RedriveDeadLetters(context.Background(), sink, c)
+	if !errors.Is(err, ErrControllerShutdown) {
+		t.Errorf("RedriveDeadLetters - want: %s, got: %v", ErrControllerShutdown, err)
+	}
+	if n != 0 {
+		t.Errorf("RedriveDeadLetters - want: %d re-driven, got: %d", 0, n)
+	}
+
+	letters, _ := sink.Drain(context.Background())
+	if len(letters) != 2 {
+		t.Fatalf("Dead letters - want: %d, got: %d", 2, len(letters))
+	}
+	if letters[0].Error != ErrControllerShutdown.Error() {
+		t.Errorf("Dead letter error - want: %s, got: %s", ErrControllerShutdown, letters[0].Error)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// LabelSelector filters functions by their labels. It is parsed from a
+// comma-separated list of requirements, all of which must match:
+//
+//	key=value, key==value  the label is set to value
+//	key!=value             the label is not set to value, or not set
+//	key                    the label is set
+//	!key                   the label is not set
+type LabelSelector struct {
+	requirements []labelRequirement
+}
+
+type labelOperator int
+
+const (
+	labelEquals labelOperator = iota
+	labelNotEquals
+	labelExists
+	labelDoesNotExist
+)
+
+type labelRequirement struct {
+	key      string
+	operator labelOperator
+	value    string
+}
+
+// ParseLabelSelector parses a selector such as "team=payments,tier!=canary".
+// An empty selector matches every function.
+func ParseLabelSelector(selector string) (*LabelSelector, error) {
+	parsed := &LabelSelector{}
+
+	if len(strings.TrimSpace(selector)) == 0 {
+		return parsed, nil
+	}
+
+	for _, term := range strings.Split(selector, ",") {
+		term = strings.TrimSpace(term)
+
+		var req labelRequirement
+		switch {
+		case strings.Contains(term, "!="):
+			req.operator = labelNotEquals
+			req.key, req.value, _ = strings.Cut(term, "!=")
+		case strings.Contains(term, "=="):
+			req.operator = labelEquals
+			req.key, req.value, _ = strings.Cut(term, "==")
+		case strings.Contains(term, "="):
+			req.operator = labelEquals
+			req.key, req.value, _ = strings.Cut(term, "=")
+		case strings.HasPrefix(term, "!"):
+			req.operator = labelDoesNotExist
+			req.key = strings.TrimPrefix(term, "!")
+		default:
+			req.operator = labelExists
+			req.key = term
+		}
+
+		req.key = strings.TrimSpace(req.key)
+		req.value = strings.TrimSpace(req.value)
+
+		if len(req.key) == 0 || strings.ContainsAny(req.key, "!=") || strings.ContainsAny(req.value, "!=") {
+			return nil, fmt.Errorf("invalid label selector requirement: %q", term)
+		}
+
+		parsed.requirements = append(parsed.requirements, req)
+	}
+
+	return parsed, nil
+}
+
+// Matches reports whether labels meet every requirement of the selector.
+// A nil selector matches all labels.
+func (s *LabelSelector) Matches(labels map[string]string) bool {
+	if s == nil {
+		return true
+	}
+
+	for _, req := range s.requirements {
+		value, ok := labels[req.key]
+
+		switch req.operator {
+		case labelEquals:
+			if !ok || value != req.value {
+				return false
+			}
+		case labelNotEquals:
+			if ok && value == req.value {
+				return false
+			}
+		case labelExists:
+			if !ok {
+				return false
+			}
+		case labelDoesNotExist:
+			if ok {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// namespaceFilter allows namespaces which match any pattern in allow, or
+// any namespace when allow is empty, unless they match a pattern in deny.
+// Patterns use the syntax of path.Match, i.e. "team-*".
+type namespaceFilter struct {
+	allow []string
+	deny  []string
+}
+
+func newNamespaceFilter(allow, deny []string) (*namespaceFilter, error) {
+	for _, pattern := range append(append([]string{}, allow...), deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid namespace pattern: %q, error: %w", pattern, err)
+		}
+	}
+
+	return &namespaceFilter{
+		allow: allow,
+		deny:  deny,
+	}, nil
+}
+
+func (f *namespaceFilter) allowed(namespace string) bool {
+	if matchAny(f.deny, namespace) {
+		return false
+	}
+
+	return len(f.allow) == 0 || matchAny(f.allow, namespace)
+}
+
+// filter returns the allowed namespaces, keeping their order
+func (f *namespaceFilter) filter(namespaces []string) []string {
+	allowed := make([]string, 0, len(namespaces))
+	for _, namespace := range namespaces {
+		if f.allowed(namespace) {
+			allowed = append(allowed, namespace)
+		}
+	}
+	return allowed
+}
+
+// matchAny reports whether name matches any of the validated patterns
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
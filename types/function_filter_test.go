@@ -0,0 +1,134 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_LabelSelector_Matches(t *testing.T) {
+	var TestCases = []struct {
+		Name     string
+		Selector string
+		Labels   map[string]string
+		Expected bool
+	}{
+		{
+			Name:     "Empty selector matches no labels",
+			Selector: "",
+			Expected: true,
+		},
+		{
+			Name:     "Equals",
+			Selector: "team=payments",
+			Labels:   map[string]string{"team": "payments"},
+			Expected: true,
+		},
+		{
+			Name:     "Double equals with spaces",
+			Selector: " team == payments ",
+			Labels:   map[string]string{"team": "payments"},
+			Expected: true,
+		},
+		{
+			Name:     "Equals with other value",
+			Selector: "team=payments",
+			Labels:   map[string]string{"team": "search"},
+			Expected: false,
+		},
+		{
+			Name:     "Not equals matches missing label",
+			Selector: "team=payments,tier!=canary",
+			Labels:   map[string]string{"team": "payments"},
+			Expected: true,
+		},
+		{
+			Name:     "Not equals",
+			Selector: "team=payments,tier!=canary",
+			Labels:   map[string]string{"team": "payments", "tier": "canary"},
+			Expected: false,
+		},
+		{
+			Name:     "Exists",
+			Selector: "team",
+			Labels:   map[string]string{"team": ""},
+			Expected: true,
+		},
+		{
+			Name:     "Does not exist",
+			Selector: "!canary",
+			Labels:   map[string]string{"canary": "true"},
+			Expected: false,
+		},
+	}
+
+	for _, test := range TestCases {
+		t.Run(test.Name, func(t *testing.T) {
+			selector, err := ParseLabelSelector(test.Selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := selector.Matches(test.Labels); got != test.Expected {
+				t.Errorf("Matches - want: %t, got: %t", test.Expected, got)
+			}
+		})
+	}
+}
+
+func Test_ParseLabelSelector_Invalid(t *testing.T) {
+	for _, selector := range []string{"=payments", "team=payments,", "team!=a=b", "!"} {
+		t.Run(selector, func(t *testing.T) {
+			if _, err := ParseLabelSelector(selector); err == nil {
+				t.Errorf("Error - want: invalid selector, got: nil")
+			}
+		})
+	}
+}
+
+func Test_namespaceFilter(t *testing.T) {
+	namespaces := []string{"", "openfaas-fn", "team-payments", "team-search", "team-payments-canary"}
+
+	var TestCases = []struct {
+		Name     string
+		Allow    []string
+		Deny     []string
+		Expected []string
+	}{
+		{
+			Name:     "No patterns allows every namespace",
+			Expected: namespaces,
+		},
+		{
+			Name:     "Allow list",
+			Allow:    []string{"team-*"},
+			Expected: []string{"team-payments", "team-search", "team-payments-canary"},
+		},
+		{
+			Name:     "Deny wins over allow",
+			Allow:    []string{"team-*"},
+			Deny:     []string{"*-canary", "team-search"},
+			Expected: []string{"team-payments"},
+		},
+		{
+			Name:     "Deny list only",
+			Deny:     []string{"team-*"},
+			Expected: []string{"", "openfaas-fn"},
+		},
+	}
+
+	for _, test := range TestCases {
+		t.Run(test.Name, func(t *testing.T) {
+			filter, err := newNamespaceFilter(test.Allow, test.Deny)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := filter.filter(namespaces); !reflect.DeepEqual(got, test.Expected) {
+				t.Errorf("Namespaces - want: %v, got: %v", test.Expected, got)
+			}
+		})
+	}
+}
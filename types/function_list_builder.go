@@ -4,10 +4,15 @@
 package types
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/openfaas/faas-provider/auth"
 	"github.com/openfaas/faas-provider/sdk"
@@ -20,67 +25,398 @@ type FunctionLookupBuilder struct {
 	Client         *http.Client
 	Credentials    *auth.BasicAuthCredentials
 	TopicDelimiter string
-	sdk            *sdk.SDK
+
+	// TopicAnnotations are the annotation keys read for the topics of each
+	// function, DefaultTopicAnnotation is used when empty.
+	TopicAnnotations []string
+
+	// TopicLabelFallback reads the topics from labels with the same keys
+	// when a function has none of the annotations.
+	TopicLabelFallback bool
+
+	// Concurrency is the number of namespaces listed in parallel, zero
+	// or one lists them one after another.
+	Concurrency int
+
+	// Namespaces and ExcludeNamespaces are path.Match patterns of the
+	// namespaces to list functions in, or not. Every namespace is listed
+	// when Namespaces is empty.
+	Namespaces        []string
+	ExcludeNamespaces []string
+
+	// Selector is a label selector which functions must match to be added
+	// to the map, see ParseLabelSelector.
+	Selector string
+
+	sdk *sdk.SDK
+
+	// known holds the entries last built for each namespace, which are
+	// kept when listing the namespace fails, guarded by lock.
+	known map[string]*namespaceLookup
+	lock  sync.Mutex
+}
+
+// namespaceLookup holds the topics and functions built for a namespace
+type namespaceLookup struct {
+	serviceMap map[string][]string
+	functions  map[string]FunctionMetadata
+
+	// malformed lists annotations which could not be read
+	malformed []AnnotationError
+}
+
+// NamespaceError is returned when the functions in a namespace could not be
+// listed.
+type NamespaceError struct {
+	Namespace string
+	Err       error
+}
+
+func (e *NamespaceError) Error() string {
+	return fmt.Sprintf("unable to get functions in: %s, error: %s", e.Namespace, e.Err)
+}
+
+func (e *NamespaceError) Unwrap() error {
+	return e.Err
+}
+
+// BuildError is returned by Build when some namespaces could not be listed,
+// or some functions have malformed topic annotations, or a
+// FileFunctionSource has malformed topics. The map returned alongside it
+// is still usable: it holds the entries for every namespace which was
+// listed, and the previously known entries for those which failed.
+// Functions are not subscribed to topics from malformed values.
+type BuildError struct {
+	// Namespaces lists each namespace which could not be listed
+	Namespaces []NamespaceError
+
+	// Total is the number of namespaces which were listed or attempted
+	Total int
+
+	// Annotations lists each malformed topic annotation or label
+	Annotations []AnnotationError
+
+	// Topics lists each malformed topic read from a FileFunctionSource
+	Topics []TopicError
+}
+
+func (e *BuildError) Error() string {
+	var messages []string
+
+	if len(e.Namespaces) > 0 {
+		failures := make([]string, len(e.Namespaces))
+		for i, ns := range e.Namespaces {
+			failures[i] = fmt.Sprintf("%s: %s", ns.Namespace, ns.Err)
+		}
+
+		messages = append(messages, fmt.Sprintf("unable to get functions in %d of %d namespaces, errors: %s",
+			len(e.Namespaces), e.Total, strings.Join(failures, "; ")))
+	}
+
+	for _, annotation := range e.Annotations {
+		messages = append(messages, annotation.Error())
+	}
+
+	for _, topic := range e.Topics {
+		messages = append(messages, topic.Error())
+	}
+
+	return strings.Join(messages, "; ")
 }
 
 func NewFunctionLookupBuilder(gatewayURL, topicDelimiter string, client *http.Client, credentials *auth.BasicAuthCredentials) *FunctionLookupBuilder {
 	u, _ := url.Parse(gatewayURL)
+
+	// NewSDK does not use the client it is passed
+	s := sdk.NewSDK(u, credentials, client)
+	s.Client = client
+
 	return &FunctionLookupBuilder{
-		sdk:            sdk.NewSDK(u, credentials, client),
+		GatewayURL:     gatewayURL,
+		Client:         client,
+		Credentials:    credentials,
 		TopicDelimiter: topicDelimiter,
+		sdk:            s,
 	}
 }
 
 // Build compiles a map of topic names and functions that have
-// advertised to receive messages on said topic
+// advertised to receive messages on said topic. When only some namespaces
+// fail, the map is returned along with a *BuildError.
 func (s *FunctionLookupBuilder) Build() (map[string][]string, error) {
 	var err error
 
-	namespaces, err := s.sdk.GetNamespaces()
+	namespaces, err := s.getNamespaces()
 	if err != nil {
 		return map[string][]string{}, err
 	}
 
-	serviceMap := make(map[string][]string)
-
 	if len(namespaces) == 0 {
 		namespaces = []string{""}
 	}
 
-	for _, namespace := range namespaces {
-		functions, err := s.sdk.GetFunctions(namespace)
-		if err != nil {
-			return map[string][]string{}, fmt.Errorf("unable to get functions in: %s, error: %w", namespace, err)
+	filter, err := newNamespaceFilter(s.Namespaces, s.ExcludeNamespaces)
+	if err != nil {
+		return map[string][]string{}, err
+	}
+	namespaces = filter.filter(namespaces)
+
+	selector, err := ParseLabelSelector(s.Selector)
+	if err != nil {
+		return map[string][]string{}, err
+	}
+
+	results := make([]*namespaceLookup, len(namespaces))
+	errs := make([]error, len(namespaces))
+
+	fanOut(context.Background(), nil, s.Concurrency, len(namespaces), func(i int) {
+		results[i], errs[i] = s.buildNamespace(namespaces[i], selector)
+	}, func(i int, err error) {
+		errs[i] = err
+	})
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	known := make(map[string]*namespaceLookup, len(namespaces))
+	buildErr := &BuildError{Total: len(namespaces)}
+
+	for i, namespace := range namespaces {
+		if errs[i] != nil {
+			buildErr.Namespaces = append(buildErr.Namespaces, NamespaceError{Namespace: namespace, Err: errs[i]})
+			results[i] = s.known[namespace]
+		} else if results[i] != nil {
+			buildErr.Annotations = append(buildErr.Annotations, results[i].malformed...)
+		}
+		if results[i] != nil {
+			known[namespace] = results[i]
+		}
+	}
+	s.known = known
+
+	serviceMap := make(map[string][]string)
+	for _, result := range results {
+		if result == nil {
+			continue
+		}
+		for topic, functions := range result.serviceMap {
+			serviceMap[topic] = append(serviceMap[topic], functions...)
+		}
+	}
+
+	if len(buildErr.Namespaces) > 0 || len(buildErr.Annotations) > 0 {
+		return serviceMap, buildErr
+	}
+
+	return serviceMap, nil
+}
+
+// seed sets the known functions before the first Build, i.e. from a
+// restored TopicMapSnapshot, so that they are kept for any namespace
+// which cannot be listed.
+func (s *FunctionLookupBuilder) seed(functions map[string]FunctionMetadata) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	known := make(map[string]*namespaceLookup)
+	for name, function := range functions {
+		lookup, ok := known[function.Namespace]
+		if !ok {
+			lookup = &namespaceLookup{
+				serviceMap: map[string][]string{},
+				functions:  map[string]FunctionMetadata{},
+			}
+			known[function.Namespace] = lookup
+		}
+
+		lookup.functions[name] = function
+		for _, topic := range function.Topics {
+			lookup.serviceMap[topic] = append(lookup.serviceMap[topic], name)
+		}
+	}
+
+	for _, lookup := range known {
+		for _, names := range lookup.serviceMap {
+			sort.Strings(names)
+		}
+	}
+
+	s.known = known
+}
+
+// getNamespaces lists the namespaces on the gateway. It is used in place
+// of the SDK's GetNamespaces, which returns no namespaces and no error for
+// a non-2xx response with an empty body, and would wipe the known
+// functions.
+func (s *FunctionLookupBuilder) getNamespaces() ([]string, error) {
+	u := *s.sdk.GatewayURL
+	u.Path = "/system/namespaces"
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create request: %s, error: %w", u.String(), err)
+	}
+
+	if s.sdk.Credentials != nil {
+		req.SetBasicAuth(s.sdk.Credentials.User, s.sdk.Credentials.Password)
+	}
+
+	client := s.sdk.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list namespaces, error: %w", err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read namespaces, error: %w", err)
+	}
+
+	if res.StatusCode < http.StatusOK || res.StatusCode >= http.StatusMultipleChoices {
+		return nil, fmt.Errorf("unexpected status code listing namespaces: %d, body: %s", res.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var namespaces []string
+	if len(body) == 0 {
+		return namespaces, nil
+	}
+
+	if err := json.Unmarshal(body, &namespaces); err != nil {
+		return nil, fmt.Errorf("unable to parse namespaces: %s, error: %w", string(body), err)
+	}
+
+	return namespaces, nil
+}
+
+// Functions returns the metadata of the functions in the map returned by
+// the last Build, including those kept for namespaces which failed.
+func (s *FunctionLookupBuilder) Functions() map[string]FunctionMetadata {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	functions := make(map[string]FunctionMetadata)
+	for _, result := range s.known {
+		for name, function := range result.functions {
+			functions[name] = function
 		}
-		serviceMap = buildServiceMap(&functions, s.TopicDelimiter, namespace, serviceMap)
 	}
 
-	return serviceMap, err
+	return functions
 }
 
-func buildServiceMap(functions *[]types.FunctionStatus, topicDelimiter, namespace string, serviceMap map[string][]string) map[string][]string {
-	for _, function := range *functions {
+// buildNamespace lists the functions in a single namespace which match
+// selector. Each call uses its own copy of the SDK, which modifies its
+// GatewayURL for every request.
+func (s *FunctionLookupBuilder) buildNamespace(namespace string, selector *LabelSelector) (*namespaceLookup, error) {
+	u := *s.sdk.GatewayURL
+	client := &sdk.SDK{
+		GatewayURL:  &u,
+		Client:      s.sdk.Client,
+		Credentials: s.sdk.Credentials,
+	}
+
+	listed, err := client.GetFunctions(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	functions := make([]types.FunctionStatus, 0, len(listed))
+	for _, function := range listed {
+		var labels map[string]string
+		if function.Labels != nil {
+			labels = *function.Labels
+		}
+		if selector.Matches(labels) {
+			functions = append(functions, function)
+		}
+	}
 
-		if function.Annotations != nil {
+	serviceMap, malformed := s.buildServiceMap(functions, namespace)
+	metadata, malformedOptions := buildFunctionMetadata(functions, namespace, serviceMap)
 
-			annotations := *function.Annotations
+	return &namespaceLookup{
+		serviceMap: serviceMap,
+		functions:  metadata,
+		malformed:  append(malformed, malformedOptions...),
+	}, nil
+}
 
-			if topicNames, exist := annotations["topic"]; exist {
+// buildFunctionMetadata describes each function in serviceMap, keyed by
+// its name in the map, and returns any malformed options.
+func buildFunctionMetadata(functions []types.FunctionStatus, namespace string, serviceMap map[string][]string) (map[string]FunctionMetadata, []AnnotationError) {
+	byName := make(map[string]types.FunctionStatus, len(functions))
+	for _, function := range functions {
+		byName[functionPath(function.Name, namespace)] = function
+	}
 
-				if len(topicDelimiter) > 0 && strings.Count(topicNames, topicDelimiter) > 0 {
+	var malformed []AnnotationError
 
-					topicSlice := strings.Split(topicNames, topicDelimiter)
+	metadata := make(map[string]FunctionMetadata)
+	for topic, names := range serviceMap {
+		for _, name := range names {
+			function, ok := metadata[name]
+			if !ok {
+				status := byName[name]
+				function = FunctionMetadata{
+					Name:        status.Name,
+					Namespace:   namespace,
+					Labels:      copyStringMap(status.Labels),
+					Annotations: copyStringMap(status.Annotations),
+				}
 
-					for _, topic := range topicSlice {
-						serviceMap = appendServiceMap(topic, function.Name, namespace, serviceMap)
-					}
-				} else {
-					serviceMap = appendServiceMap(topicNames, function.Name, namespace, serviceMap)
+				var errs []AnnotationError
+				function.Options, errs = parseFunctionOptions(function.Annotations)
+				for _, err := range errs {
+					err.Function, err.Namespace = status.Name, namespace
+					malformed = append(malformed, err)
 				}
 			}
+			function.Topics = append(function.Topics, topic)
+			metadata[name] = function
+		}
+	}
+
+	for name, function := range metadata {
+		sort.Strings(function.Topics)
+		metadata[name] = function
+	}
+
+	return metadata, malformed
+}
+
+func copyStringMap(m *map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+
+	copied := make(map[string]string, len(*m))
+	for k, v := range *m {
+		copied[k] = v
+	}
+	return copied
+}
+
+// buildServiceMap subscribes each function to the topics read from its
+// annotations, and returns any which were malformed.
+func (s *FunctionLookupBuilder) buildServiceMap(functions []types.FunctionStatus, namespace string) (map[string][]string, []AnnotationError) {
+	serviceMap := make(map[string][]string)
+
+	var malformed []AnnotationError
+	for _, function := range functions {
+		topics, errs := s.functionTopics(function, namespace)
+		malformed = append(malformed, errs...)
+
+		for _, topic := range topics {
+			serviceMap = appendServiceMap(topic, function.Name, namespace, serviceMap)
 		}
 	}
-	return serviceMap
+
+	return serviceMap, malformed
 }
 
 func appendServiceMap(key, function, namespace string, sm map[string][]string) map[string][]string {
@@ -92,14 +428,16 @@ func appendServiceMap(key, function, namespace string, sm map[string][]string) m
 		if sm[key] == nil {
 			sm[key] = []string{}
 		}
-		sep := ""
-		if len(namespace) > 0 {
-			sep = "."
-		}
-
-		functionPath := fmt.Sprintf("%s%s%s", function, sep, namespace)
-		sm[key] = append(sm[key], functionPath)
+		sm[key] = append(sm[key], functionPath(function, namespace))
 	}
 
 	return sm
 }
+
+// functionPath is the name a function is invoked by on the gateway
+func functionPath(function, namespace string) string {
+	if len(namespace) > 0 {
+		return fmt.Sprintf("%s.%s", function, namespace)
+	}
+	return function
+}
@@ -5,9 +5,13 @@ package types
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
+	"sort"
+	"sync"
 	"testing"
 
 	"github.com/openfaas/faas-provider/sdk"
@@ -386,3 +390,474 @@ func Test_BuildMultipleNamespaceFunction(t *testing.T) {
 		t.Errorf("Topic %s - want: %d functions, got: %d", "topic1", 2, len(functions))
 	}
 }
+
+func Test_Build_PartialNamespaceFailure(t *testing.T) {
+	failing := map[string]bool{"ns-c": true}
+	lock := sync.Mutex{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/system/namespaces" {
+			bytesOut, _ := json.Marshal([]string{"ns-a", "ns-b", "ns-c"})
+			_, _ = w.Write(bytesOut)
+			return
+		}
+
+		namespace := r.URL.Query().Get("namespace")
+
+		lock.Lock()
+		fail := failing[namespace]
+		lock.Unlock()
+
+		if fail {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		functions := []types.FunctionStatus{{
+			Name:        "echo",
+			Annotations: &map[string]string{"topic": "topic1"},
+			Namespace:   namespace,
+		}}
+		bytesOut, _ := json.Marshal(functions)
+		_, _ = w.Write(bytesOut)
+	}))
+	defer srv.Close()
+
+	builder := NewFunctionLookupBuilder(srv.URL, ",", srv.Client(), nil)
+	builder.Concurrency = 2
+
+	var TestCases = []struct {
+		Name             string
+		Failing          map[string]bool
+		ExpectedFailed   []string
+		ExpectedFunction []string
+	}{
+		{
+			Name:             "Namespace never listed has no entries",
+			Failing:          map[string]bool{"ns-c": true},
+			ExpectedFailed:   []string{"ns-c"},
+			ExpectedFunction: []string{"echo.ns-a", "echo.ns-b"},
+		},
+		{
+			Name:             "All namespaces listed",
+			Failing:          map[string]bool{},
+			ExpectedFunction: []string{"echo.ns-a", "echo.ns-b", "echo.ns-c"},
+		},
+		{
+			Name:             "Failed namespace keeps previous entries",
+			Failing:          map[string]bool{"ns-b": true},
+			ExpectedFailed:   []string{"ns-b"},
+			ExpectedFunction: []string{"echo.ns-a", "echo.ns-b", "echo.ns-c"},
+		},
+	}
+
+	for _, test := range TestCases {
+		t.Run(test.Name, func(t *testing.T) {
+			lock.Lock()
+			failing = test.Failing
+			lock.Unlock()
+
+			lookup, err := builder.Build()
+
+			var failed []string
+			var buildErr *BuildError
+			if errors.As(err, &buildErr) {
+				for _, ns := range buildErr.Namespaces {
+					failed = append(failed, ns.Namespace)
+				}
+				if buildErr.Total != 3 {
+					t.Errorf("Total - want: %d, got: %d", 3, buildErr.Total)
+				}
+			} else if err != nil {
+				t.Fatalf("Error - want: *BuildError, got: %s", err)
+			}
+
+			if len(failed) != len(test.ExpectedFailed) {
+				t.Errorf("Failed namespaces - want: %v, got: %v", test.ExpectedFailed, failed)
+			}
+
+			functions := lookup["topic1"]
+			sort.Strings(functions)
+			if len(functions) != len(test.ExpectedFunction) {
+				t.Fatalf("Functions - want: %v, got: %v", test.ExpectedFunction, functions)
+			}
+			for i, function := range functions {
+				if function != test.ExpectedFunction[i] {
+					t.Errorf("Function %d - want: %s, got: %s", i, test.ExpectedFunction[i], function)
+				}
+			}
+		})
+	}
+}
+
+func Test_Build_NamespacesStatus(t *testing.T) {
+	var lock sync.Mutex
+	var status int
+	var body string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/system/namespaces" {
+			lock.Lock()
+			defer lock.Unlock()
+
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(body))
+			return
+		}
+
+		functions := []types.FunctionStatus{{
+			Name:        "echo",
+			Annotations: &map[string]string{"topic": "topic1"},
+			Namespace:   r.URL.Query().Get("namespace"),
+		}}
+		bytesOut, _ := json.Marshal(functions)
+		_, _ = w.Write(bytesOut)
+	}))
+	defer srv.Close()
+
+	builder := NewFunctionLookupBuilder(srv.URL, ",", srv.Client(), nil)
+
+	// Each case builds on the functions known from the one before
+	var TestCases = []struct {
+		Name          string
+		Status        int
+		Body          string
+		ExpectedError bool
+		Expected      []string
+	}{
+		{Name: "Namespaces listed", Status: http.StatusOK, Body: `["openfaas-fn"]`, Expected: []string{"echo.openfaas-fn"}},
+		{Name: "Non-2xx with an empty body", Status: http.StatusBadGateway, ExpectedError: true, Expected: []string{"echo.openfaas-fn"}},
+		{Name: "Non-2xx with a body", Status: http.StatusBadGateway, Body: "upstream unavailable", ExpectedError: true, Expected: []string{"echo.openfaas-fn"}},
+		{Name: "Empty body", Status: http.StatusOK, Expected: []string{"echo"}},
+		{Name: "Namespaces listed again", Status: http.StatusOK, Body: `["openfaas-fn"]`, Expected: []string{"echo.openfaas-fn"}},
+		{Name: "No namespaces", Status: http.StatusOK, Body: `[]`, Expected: []string{"echo"}},
+	}
+
+	for _, test := range TestCases {
+		lock.Lock()
+		status, body = test.Status, test.Body
+		lock.Unlock()
+
+		_, err := builder.Build()
+		if (err != nil) != test.ExpectedError {
+			t.Errorf("%s: Error - want error: %t, got: %v", test.Name, test.ExpectedError, err)
+		}
+
+		var functions []string
+		for name := range builder.Functions() {
+			functions = append(functions, name)
+		}
+		if !reflect.DeepEqual(functions, test.Expected) {
+			t.Errorf("%s: Functions - want: %v, got: %v", test.Name, test.Expected, functions)
+		}
+	}
+}
+
+func Test_Build_FunctionMetadata(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/system/namespaces" {
+			bytesOut, _ := json.Marshal([]string{"openfaas-fn"})
+			_, _ = w.Write(bytesOut)
+			return
+		}
+
+		functions := []types.FunctionStatus{
+			{
+				Name:        "echo",
+				Namespace:   "openfaas-fn",
+				Annotations: &map[string]string{"topic": "topic2,topic1"},
+				Labels:      &map[string]string{"team": "payments"},
+			},
+			{
+				Name:      "unsubscribed",
+				Namespace: "openfaas-fn",
+			},
+		}
+		bytesOut, _ := json.Marshal(functions)
+		_, _ = w.Write(bytesOut)
+	}))
+	defer srv.Close()
+
+	builder := NewFunctionLookupBuilder(srv.URL, ",", srv.Client(), nil)
+	if _, err := builder.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]FunctionMetadata{
+		"echo.openfaas-fn": {
+			Name:        "echo",
+			Namespace:   "openfaas-fn",
+			Topics:      []string{"topic1", "topic2"},
+			Labels:      map[string]string{"team": "payments"},
+			Annotations: map[string]string{"topic": "topic2,topic1"},
+		},
+	}
+
+	if got := builder.Functions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Functions - want: %+v, got: %+v", want, got)
+	}
+}
+
+func Test_buildServiceMap_TopicAnnotations(t *testing.T) {
+	var TestCases = []struct {
+		Name              string
+		Keys              []string
+		LabelFallback     bool
+		Annotations       map[string]string
+		Labels            map[string]string
+		ExpectedTopics    []string
+		ExpectedMalformed []string
+	}{
+		{
+			Name:           "Default key",
+			Annotations:    map[string]string{"topic": "topic1,topic2"},
+			ExpectedTopics: []string{"topic1", "topic2"},
+		},
+		{
+			Name:           "Custom key ignores default",
+			Keys:           []string{"kafka-topic"},
+			Annotations:    map[string]string{"topic": "topic1", "kafka-topic": "topic2"},
+			ExpectedTopics: []string{"topic2"},
+		},
+		{
+			Name:           "Several keys are merged",
+			Keys:           []string{"kafka-topic", "nats-topic"},
+			Annotations:    map[string]string{"kafka-topic": "topic1,topic2", "nats-topic": "topic2,topic3"},
+			ExpectedTopics: []string{"topic1", "topic2", "topic3"},
+		},
+		{
+			Name:           "JSON array",
+			Annotations:    map[string]string{"topic": ` ["topic1", "orders.>"] `},
+			ExpectedTopics: []string{"orders.>", "topic1"},
+		},
+		{
+			Name:           "Label fallback",
+			LabelFallback:  true,
+			Labels:         map[string]string{"topic": "topic1"},
+			ExpectedTopics: []string{"topic1"},
+		},
+		{
+			Name:   "Labels ignored without fallback",
+			Labels: map[string]string{"topic": "topic1"},
+		},
+		{
+			Name:           "Annotation takes precedence over label",
+			LabelFallback:  true,
+			Annotations:    map[string]string{"topic": "topic1"},
+			Labels:         map[string]string{"topic": "topic2"},
+			ExpectedTopics: []string{"topic1"},
+		},
+		{
+			Name:              "Invalid JSON array",
+			Annotations:       map[string]string{"topic": `["topic1",`},
+			ExpectedMalformed: []string{"topic"},
+		},
+		{
+			Name:              "Empty topic in JSON array",
+			Annotations:       map[string]string{"topic": `["topic1", ""]`},
+			ExpectedMalformed: []string{"topic"},
+		},
+		{
+			Name:              "Multi-segment wildcard not last",
+			Keys:              []string{"kafka-topic", "nats-topic"},
+			Annotations:       map[string]string{"kafka-topic": "orders.>.created", "nats-topic": "topic1"},
+			ExpectedTopics:    []string{"topic1"},
+			ExpectedMalformed: []string{"kafka-topic"},
+		},
+		{
+			Name:              "Empty segment in label",
+			LabelFallback:     true,
+			Labels:            map[string]string{"topic": "orders..created"},
+			ExpectedMalformed: []string{"topic"},
+		},
+	}
+
+	for _, test := range TestCases {
+		t.Run(test.Name, func(t *testing.T) {
+			builder := FunctionLookupBuilder{
+				TopicDelimiter:     ",",
+				TopicAnnotations:   test.Keys,
+				TopicLabelFallback: test.LabelFallback,
+			}
+
+			function := types.FunctionStatus{Name: "echo"}
+			if test.Annotations != nil {
+				function.Annotations = &test.Annotations
+			}
+			if test.Labels != nil {
+				function.Labels = &test.Labels
+			}
+
+			serviceMap, malformed := builder.buildServiceMap([]types.FunctionStatus{function}, "openfaas-fn")
+
+			topics := []string{}
+			for topic := range serviceMap {
+				topics = append(topics, topic)
+			}
+			sort.Strings(topics)
+
+			if len(topics) != len(test.ExpectedTopics) {
+				t.Fatalf("Topics - want: %v, got: %v", test.ExpectedTopics, topics)
+			}
+			for i, topic := range topics {
+				if topic != test.ExpectedTopics[i] {
+					t.Errorf("Topic %d - want: %s, got: %s", i, test.ExpectedTopics[i], topic)
+				}
+			}
+
+			if len(malformed) != len(test.ExpectedMalformed) {
+				t.Fatalf("Malformed - want: %v, got: %v", test.ExpectedMalformed, malformed)
+			}
+			for i, err := range malformed {
+				if err.Key != test.ExpectedMalformed[i] || err.Label != (test.Annotations == nil) {
+					t.Errorf("Malformed %d - want: %s, got: %s", i, test.ExpectedMalformed[i], err.Error())
+				}
+			}
+		})
+	}
+}
+
+func Test_Build_ReportsMalformedAnnotations(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/system/namespaces" {
+			bytesOut, _ := json.Marshal([]string{"openfaas-fn"})
+			_, _ = w.Write(bytesOut)
+			return
+		}
+
+		functions := []types.FunctionStatus{
+			{Name: "echo", Annotations: &map[string]string{"topic": "topic1"}},
+			{Name: "broken", Annotations: &map[string]string{"topic": "[topic2"}},
+		}
+		bytesOut, _ := json.Marshal(functions)
+		_, _ = w.Write(bytesOut)
+	}))
+	defer srv.Close()
+
+	builder := NewFunctionLookupBuilder(srv.URL, ",", srv.Client(), nil)
+
+	lookup, err := builder.Build()
+
+	var buildErr *BuildError
+	if !errors.As(err, &buildErr) {
+		t.Fatalf("Error - want: *BuildError, got: %v", err)
+	}
+	if len(buildErr.Namespaces) != 0 || len(buildErr.Annotations) != 1 {
+		t.Errorf("BuildError - want: %d namespaces and %d annotations, got: %d and %d", 0, 1, len(buildErr.Namespaces), len(buildErr.Annotations))
+	}
+	if len(lookup) != 1 || len(lookup["topic1"]) != 1 {
+		t.Errorf("Lookup - want: %v, got: %v", map[string][]string{"topic1": {"echo.openfaas-fn"}}, lookup)
+	}
+}
+
+func Test_Build_FiltersNamespacesAndLabels(t *testing.T) {
+	listed := make(chan string, 10)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/system/namespaces" {
+			bytesOut, _ := json.Marshal([]string{"team-payments", "team-search", "team-payments-canary", "kube-system"})
+			_, _ = w.Write(bytesOut)
+			return
+		}
+
+		namespace := r.URL.Query().Get("namespace")
+		listed <- namespace
+
+		functions := []types.FunctionStatus{
+			{
+				Name:        "charge",
+				Namespace:   namespace,
+				Annotations: &map[string]string{"topic": "payments"},
+				Labels:      &map[string]string{"team": "payments"},
+			},
+			{
+				Name:        "charge-canary",
+				Namespace:   namespace,
+				Annotations: &map[string]string{"topic": "payments"},
+				Labels:      &map[string]string{"team": "payments", "tier": "canary"},
+			},
+			{
+				Name:        "unlabelled",
+				Namespace:   namespace,
+				Annotations: &map[string]string{"topic": "payments"},
+			},
+		}
+		bytesOut, _ := json.Marshal(functions)
+		_, _ = w.Write(bytesOut)
+	}))
+	defer srv.Close()
+
+	builder := NewFunctionLookupBuilder(srv.URL, ",", srv.Client(), nil)
+	builder.Namespaces = []string{"team-*"}
+	builder.ExcludeNamespaces = []string{"*-canary"}
+	builder.Selector = "team=payments,tier!=canary"
+
+	lookups, err := builder.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(listed)
+
+	var namespaces []string
+	for namespace := range listed {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	wantNamespaces := []string{"team-payments", "team-search"}
+	if !reflect.DeepEqual(namespaces, wantNamespaces) {
+		t.Errorf("Namespaces listed - want: %v, got: %v", wantNamespaces, namespaces)
+	}
+
+	want := map[string][]string{"payments": {"charge.team-payments", "charge.team-search"}}
+	if !reflect.DeepEqual(lookups, want) {
+		t.Errorf("Lookups - want: %v, got: %v", want, lookups)
+	}
+
+	if _, ok := builder.Functions()["charge-canary.team-payments"]; ok {
+		t.Errorf("Functions - want: %s excluded, got: included", "charge-canary.team-payments")
+	}
+}
+
+func Test_Build_InvalidFilters(t *testing.T) {
+	var TestCases = []struct {
+		Name              string
+		Namespaces        []string
+		ExcludeNamespaces []string
+		Selector          string
+	}{
+		{
+			Name:       "Invalid namespace pattern",
+			Namespaces: []string{"team-["},
+		},
+		{
+			Name:     "Invalid selector",
+			Selector: "team=payments,=canary",
+		},
+	}
+
+	for _, test := range TestCases {
+		t.Run(test.Name, func(t *testing.T) {
+			listed := false
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/system/namespaces" {
+					listed = true
+				}
+				_, _ = w.Write([]byte("[]"))
+			}))
+			defer srv.Close()
+
+			builder := NewFunctionLookupBuilder(srv.URL, ",", srv.Client(), nil)
+			builder.Namespaces = test.Namespaces
+			builder.ExcludeNamespaces = test.ExcludeNamespaces
+			builder.Selector = test.Selector
+
+			if _, err := builder.Build(); err == nil {
+				t.Errorf("Error - want: invalid filter, got: nil")
+			}
+			if listed {
+				t.Errorf("Functions - want: not listed, got: listed")
+			}
+		})
+	}
+}
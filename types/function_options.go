@@ -0,0 +1,147 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FunctionOptionsPrefix is the prefix of the annotations which override
+// how the connector invokes a function, i.e. "com.openfaas.connector.timeout".
+const FunctionOptionsPrefix = "com.openfaas.connector."
+
+// QueueNameHeader tells the gateway which queue to publish an asynchronous
+// invocation to, when FunctionOptions.Queue is set.
+const QueueNameHeader = "X-Queue-Name"
+
+// FunctionOptions override the controller-wide settings for invoking a
+// single function. They are read from annotations with the
+// FunctionOptionsPrefix, and unset fields keep the controller's setting.
+type FunctionOptions struct {
+	// Async invokes the function via the asynchronous route when true, and
+	// the synchronous route when false. Annotation: "async".
+	Async *bool `json:"async,omitempty"`
+
+	// Timeout for each request to the function, given as a duration such
+	// as "2m" or a number of seconds. Annotation: "timeout".
+	Timeout time.Duration `json:"timeout,omitempty"`
+
+	// ContentType sets the Content-Type header. Annotation: "content-type".
+	ContentType string `json:"contentType,omitempty"`
+
+	// MaxRetries is the number of times a failed invocation is retried,
+	// zero disables retries. Annotation: "max-retries".
+	MaxRetries *int `json:"maxRetries,omitempty"`
+
+	// Queue is the queue asynchronous invocations are published to, sent
+	// in the QueueNameHeader. Annotation: "queue".
+	Queue string `json:"queue,omitempty"`
+}
+
+// functionRetryBackoff is the base backoff for a function which sets
+// max-retries when the controller has no RetryPolicy.
+const functionRetryBackoff = time.Second
+
+// parseFunctionOptions reads the options of a function from its
+// annotations, reporting any value which cannot be parsed.
+func parseFunctionOptions(annotations map[string]string) (FunctionOptions, []AnnotationError) {
+	var options FunctionOptions
+	var errs []AnnotationError
+
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		if strings.HasPrefix(key, FunctionOptionsPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := strings.TrimSpace(annotations[key])
+
+		var err error
+		switch strings.TrimPrefix(key, FunctionOptionsPrefix) {
+		case "async":
+			var async bool
+			if async, err = strconv.ParseBool(value); err == nil {
+				options.Async = &async
+			}
+		case "timeout":
+			options.Timeout, err = parseTimeout(value)
+		case "content-type":
+			options.ContentType = value
+		case "max-retries":
+			var retries int
+			retries, err = strconv.Atoi(value)
+			if err == nil && retries < 0 {
+				err = errors.New("must not be negative")
+			}
+			if err == nil {
+				options.MaxRetries = &retries
+			}
+		case "queue":
+			options.Queue = value
+		default:
+			continue
+		}
+
+		if err != nil {
+			errs = append(errs, AnnotationError{Key: key, Value: annotations[key], Err: err})
+		}
+	}
+
+	return options, errs
+}
+
+// parseTimeout reads a positive duration, or a number of seconds
+func parseTimeout(value string) (time.Duration, error) {
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, secondsErr := strconv.Atoi(value)
+		if secondsErr != nil {
+			return 0, err
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	if timeout <= 0 {
+		return 0, errors.New("must be positive")
+	}
+
+	return timeout, nil
+}
+
+// route returns the URL prefix the function is invoked on, switching
+// between the synchronous and asynchronous routes of gatewayURL when Async
+// is set.
+func (o *FunctionOptions) route(gatewayURL string) string {
+	if o == nil || o.Async == nil {
+		return gatewayURL
+	}
+
+	base := strings.TrimSuffix(strings.TrimSuffix(gatewayURL, "/async-function"), "/function")
+	if *o.Async {
+		return base + "/async-function"
+	}
+	return base + "/function"
+}
+
+// retryPolicy applies MaxRetries to the controller's policy
+func (o *FunctionOptions) retryPolicy(policy *RetryPolicy) *RetryPolicy {
+	if o == nil || o.MaxRetries == nil {
+		return policy
+	}
+
+	override := RetryPolicy{BaseBackoff: functionRetryBackoff}
+	if policy != nil {
+		override = *policy
+	}
+	override.MaxAttempts = *o.MaxRetries + 1
+
+	return &override
+}
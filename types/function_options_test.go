@@ -0,0 +1,160 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_parseFunctionOptions(t *testing.T) {
+	async, retries := true, 2
+
+	var TestCases = []struct {
+		Name              string
+		Annotations       map[string]string
+		Expected          FunctionOptions
+		ExpectedMalformed []string
+	}{
+		{
+			Name:     "No options",
+			Expected: FunctionOptions{},
+		},
+		{
+			Name: "All options",
+			Annotations: map[string]string{
+				"com.openfaas.connector.async":        "true",
+				"com.openfaas.connector.timeout":      "2m",
+				"com.openfaas.connector.content-type": "application/json",
+				"com.openfaas.connector.max-retries":  "2",
+				"com.openfaas.connector.queue":        "slow-queue",
+				"topic":                               "topic1",
+			},
+			Expected: FunctionOptions{
+				Async:       &async,
+				Timeout:     2 * time.Minute,
+				ContentType: "application/json",
+				MaxRetries:  &retries,
+				Queue:       "slow-queue",
+			},
+		},
+		{
+			Name:        "Timeout in seconds",
+			Annotations: map[string]string{"com.openfaas.connector.timeout": "90"},
+			Expected:    FunctionOptions{Timeout: 90 * time.Second},
+		},
+		{
+			Name:        "Unknown option is ignored",
+			Annotations: map[string]string{"com.openfaas.connector.unknown": "value"},
+			Expected:    FunctionOptions{},
+		},
+		{
+			Name: "Malformed options",
+			Annotations: map[string]string{
+				"com.openfaas.connector.async":       "sometimes",
+				"com.openfaas.connector.timeout":     "-1s",
+				"com.openfaas.connector.max-retries": "-1",
+				"com.openfaas.connector.queue":       "slow-queue",
+			},
+			Expected: FunctionOptions{Queue: "slow-queue"},
+			ExpectedMalformed: []string{
+				"com.openfaas.connector.async",
+				"com.openfaas.connector.max-retries",
+				"com.openfaas.connector.timeout",
+			},
+		},
+	}
+
+	for _, test := range TestCases {
+		t.Run(test.Name, func(t *testing.T) {
+			options, malformed := parseFunctionOptions(test.Annotations)
+
+			if !reflect.DeepEqual(options, test.Expected) {
+				t.Errorf("Options - want: %+v, got: %+v", test.Expected, options)
+			}
+
+			if len(malformed) != len(test.ExpectedMalformed) {
+				t.Fatalf("Malformed - want: %v, got: %v", test.ExpectedMalformed, malformed)
+			}
+			for i, err := range malformed {
+				if err.Key != test.ExpectedMalformed[i] {
+					t.Errorf("Malformed %d - want: %s, got: %s", i, test.ExpectedMalformed[i], err.Key)
+				}
+			}
+		})
+	}
+}
+
+func Test_Invoker_AppliesFunctionOptions(t *testing.T) {
+	type request struct {
+		path        string
+		contentType string
+		queue       string
+	}
+	requests := make(chan request, 10)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- request{
+			path:        r.URL.Path,
+			contentType: r.Header.Get("Content-Type"),
+			queue:       r.Header.Get(QueueNameHeader),
+		}
+		if r.URL.Path == "/function/slow" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	async, retries := true, 1
+
+	topicMap := NewTopicMap()
+	lookup := map[string][]string{"topic1": {"queued", "slow"}}
+	topicMap.SyncFunctions(&lookup, map[string]FunctionMetadata{
+		"queued": {Name: "queued", Options: FunctionOptions{
+			Async:       &async,
+			ContentType: "application/json",
+			MaxRetries:  &retries,
+			Queue:       "slow-queue",
+		}},
+		"slow": {Name: "slow", Options: FunctionOptions{Timeout: 10 * time.Millisecond}},
+	})
+
+	invoker := NewInvoker(srv.URL+"/function", srv.Client(), "text/plain", false, false, "")
+	invoker.RetryPolicy = &RetryPolicy{MaxAttempts: 5, BaseBackoff: time.Millisecond}
+	collect := collectResponses(invoker)
+
+	responses := invoker.Publish(context.Background(), &topicMap, &Message{Topic: "topic1", Body: []byte("hello")})
+	collect()
+
+	// Close waits for the slow handler to return
+	srv.Close()
+	close(requests)
+
+	if responses[0].Attempts != 2 {
+		t.Errorf("Attempts with max-retries - want: %d, got: %d", 2, responses[0].Attempts)
+	}
+	if responses[1].Error == nil {
+		t.Errorf("Error with timeout - want: timeout, got: nil")
+	}
+
+	for req := range requests {
+		switch req.path {
+		case "/async-function/queued":
+			if req.contentType != "application/json" || req.queue != "slow-queue" {
+				t.Errorf("Headers - want: %s and %s, got: %s and %s", "application/json", "slow-queue", req.contentType, req.queue)
+			}
+		case "/function/slow":
+			if req.contentType != "text/plain" || req.queue != "" {
+				t.Errorf("Headers - want: %s and no queue, got: %s and %s", "text/plain", req.contentType, req.queue)
+			}
+		default:
+			t.Errorf("Path - want: %s or %s, got: %s", "/async-function/queued", "/function/slow", req.path)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultWatchInterval is how often a watched file is checked for changes
+// when no interval is given.
+const DefaultWatchInterval = time.Second
+
+// FunctionSource builds the map of topics to the functions which subscribe
+// to them, which is synced into the controller's TopicMap every
+// RebuildInterval. FunctionLookupBuilder is the default source, which
+// queries the gateway.
+type FunctionSource interface {
+	Build() (map[string][]string, error)
+}
+
+// FunctionSourceWatcher can be implemented by a FunctionSource which knows
+// when it has changed, so that the TopicMap is synced straight away rather
+// than at the next RebuildInterval. Watch sends on the returned channel
+// after each change, until stop is closed.
+type FunctionSourceWatcher interface {
+	Watch(stop <-chan struct{}) <-chan struct{}
+}
+
+// FunctionMetadata describes a function which subscribes to topics
+type FunctionMetadata struct {
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace,omitempty"`
+	Topics      []string          `json:"topics"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// Options override how the function is invoked
+	Options FunctionOptions `json:"options,omitempty"`
+}
+
+// FunctionMetadataSource can be implemented by a FunctionSource to provide
+// the metadata of the functions in the map returned by its last Build,
+// keyed by the function names in the map.
+type FunctionMetadataSource interface {
+	Functions() map[string]FunctionMetadata
+}
+
+// FileFunctionSource reads the topic map from a YAML or JSON file, which
+// holds the functions subscribed to each topic:
+//
+//	orders.created:
+//	- billing.openfaas-fn
+//	- shipping.openfaas-fn
+//
+// Files ending in ".json" are parsed as JSON, any other file as YAML. The
+// file is read again on every Build.
+type FileFunctionSource struct {
+	Path string
+}
+
+// NewFileFunctionSource creates a FunctionSource which reads the topic map
+// from the file at path.
+func NewFileFunctionSource(path string) *FileFunctionSource {
+	return &FileFunctionSource{
+		Path: path,
+	}
+}
+
+// TopicError is a malformed topic read from a FileFunctionSource
+type TopicError struct {
+	Path  string
+	Topic string
+	Err   error
+}
+
+func (e *TopicError) Error() string {
+	return fmt.Sprintf("malformed topic: %q in: %s, error: %s", e.Topic, e.Path, e.Err)
+}
+
+func (e *TopicError) Unwrap() error {
+	return e.Err
+}
+
+// Build reads and parses the file. Malformed topics are skipped and
+// returned along with the map in a *BuildError.
+func (f *FileFunctionSource) Build() (map[string][]string, error) {
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		return map[string][]string{}, fmt.Errorf("unable to read topic map: %s, error: %w", f.Path, err)
+	}
+
+	lookup, malformed, err := parseTopicMap(f.Path, data)
+	if err != nil {
+		return map[string][]string{}, fmt.Errorf("unable to parse topic map: %s, error: %w", f.Path, err)
+	}
+
+	if len(malformed) > 0 {
+		return lookup, &BuildError{Topics: malformed}
+	}
+
+	return lookup, nil
+}
+
+// parseTopicMap parses data as JSON or YAML depending on the extension of
+// path, trimming and skipping empty topics and functions, and returns any
+// malformed topics.
+func parseTopicMap(path string, data []byte) (map[string][]string, []TopicError, error) {
+	parsed := map[string][]string{}
+
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		if err := json.Unmarshal(data, &parsed); err != nil {
+			return nil, nil, err
+		}
+	} else if len(bytes.TrimSpace(data)) > 0 {
+		if err := yaml.Unmarshal(data, &parsed); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var malformed []TopicError
+
+	lookup := make(map[string][]string, len(parsed))
+	for topic, functions := range parsed {
+		if trimmed := strings.TrimSpace(topic); len(trimmed) > 0 {
+			if err := validateTopic(trimmed); err != nil {
+				malformed = append(malformed, TopicError{Path: path, Topic: trimmed, Err: err})
+				continue
+			}
+		}
+
+		for _, function := range functions {
+			if function = strings.TrimSpace(function); len(function) > 0 {
+				lookup = appendServiceMap(topic, function, "", lookup)
+			}
+		}
+	}
+
+	sort.Slice(malformed, func(i, j int) bool {
+		return malformed[i].Topic < malformed[j].Topic
+	})
+
+	return lookup, malformed, nil
+}
+
+// WatchedFileFunctionSource is a FileFunctionSource which is checked for
+// changes every Interval, so that edits to the file are synced without
+// waiting for the next RebuildInterval.
+type WatchedFileFunctionSource struct {
+	FileFunctionSource
+
+	// Interval is how often the file is checked for changes
+	Interval time.Duration
+}
+
+// NewWatchedFileFunctionSource creates a FunctionSource which reads the topic
+// map from the file at path, and checks it for changes every interval. If
+// interval is zero, DefaultWatchInterval is used.
+func NewWatchedFileFunctionSource(path string, interval time.Duration) *WatchedFileFunctionSource {
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+
+	return &WatchedFileFunctionSource{
+		FileFunctionSource: FileFunctionSource{Path: path},
+		Interval:           interval,
+	}
+}
+
+// Watch sends on the returned channel whenever the size or modification
+// time of the file changes, or the file is created or removed.
+func (w *WatchedFileFunctionSource) Watch(stop <-chan struct{}) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+
+	go func() {
+		ticker := time.NewTicker(w.Interval)
+		defer ticker.Stop()
+
+		last := w.stat()
+		for {
+			select {
+			case <-ticker.C:
+				if current := w.stat(); current != last {
+					last = current
+					select {
+					case changes <- struct{}{}:
+					default:
+					}
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return changes
+}
+
+// fileVersion identifies the contents of a file without reading it
+type fileVersion struct {
+	exists  bool
+	size    int64
+	modTime time.Time
+}
+
+func (w *WatchedFileFunctionSource) stat() fileVersion {
+	return statFile(w.Path)
+}
+
+// statFile returns the version of the file at path, which is the zero
+// fileVersion if it does not exist.
+func statFile(path string) fileVersion {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileVersion{}
+	}
+
+	return fileVersion{
+		exists:  true,
+		size:    info.Size(),
+		modTime: info.ModTime(),
+	}
+}
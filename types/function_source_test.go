@@ -0,0 +1,142 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_FileFunctionSource_Build(t *testing.T) {
+	var TestCases = []struct {
+		Name          string
+		File          string
+		Content       string
+		ExpectedError bool
+		Expected      map[string][]string
+
+		// ExpectedMalformed are the topics returned in a *BuildError
+		// along with the lookup
+		ExpectedMalformed []string
+	}{
+		{
+			Name:     "YAML",
+			File:     "topics.yaml",
+			Content:  "orders.created:\n- billing.openfaas-fn\n- shipping.openfaas-fn\npayments.*:\n- audit\n",
+			Expected: map[string][]string{"orders.created": {"billing.openfaas-fn", "shipping.openfaas-fn"}, "payments.*": {"audit"}},
+		},
+		{
+			Name:     "JSON",
+			File:     "topics.json",
+			Content:  `{"orders.created": ["billing.openfaas-fn"]}`,
+			Expected: map[string][]string{"orders.created": {"billing.openfaas-fn"}},
+		},
+		{
+			Name:     "Empty topics and functions are skipped",
+			File:     "topics.yml",
+			Content:  "\" orders \":\n- \" billing \"\n- \"\"\nrefunds: []\n",
+			Expected: map[string][]string{"orders": {"billing"}},
+		},
+		{
+			Name:     "Empty file",
+			File:     "topics.yaml",
+			Expected: map[string][]string{},
+		},
+		{
+			Name:              "Malformed topics are skipped",
+			File:              "topics.yaml",
+			Content:           "orders.>.eu:\n- billing\norders..created:\n- billing\norders.>:\n- audit\n",
+			Expected:          map[string][]string{"orders.>": {"audit"}},
+			ExpectedMalformed: []string{"orders..created", "orders.>.eu"},
+		},
+		{
+			Name:          "Invalid JSON",
+			File:          "topics.json",
+			Content:       `{"orders": "billing"}`,
+			ExpectedError: true,
+		},
+		{
+			Name:          "Missing file",
+			ExpectedError: true,
+		},
+	}
+
+	for _, test := range TestCases {
+		t.Run(test.Name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "missing.yaml")
+			if len(test.File) > 0 {
+				path = filepath.Join(t.TempDir(), test.File)
+				if err := os.WriteFile(path, []byte(test.Content), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			lookup, err := NewFileFunctionSource(path).Build()
+
+			var malformed []string
+			var buildErr *BuildError
+			if errors.As(err, &buildErr) {
+				for _, topic := range buildErr.Topics {
+					malformed = append(malformed, topic.Topic)
+				}
+				err = nil
+			}
+
+			if (err != nil) != test.ExpectedError {
+				t.Fatalf("Error - want error: %t, got: %v", test.ExpectedError, err)
+			}
+			if !reflect.DeepEqual(malformed, test.ExpectedMalformed) {
+				t.Errorf("Malformed topics - want: %v, got: %v", test.ExpectedMalformed, malformed)
+			}
+
+			if !test.ExpectedError && !reflect.DeepEqual(lookup, test.Expected) {
+				t.Errorf("Lookup - want: %v, got: %v", test.Expected, lookup)
+			}
+		})
+	}
+}
+
+func Test_WatchedFileFunctionSource_SyncsChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "topics.yaml")
+	if err := os.WriteFile(path, []byte("orders:\n- billing\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewController(nil, &ControllerConfig{
+		RebuildInterval: time.Hour,
+		FunctionSource:  NewWatchedFileFunctionSource(path, 10*time.Millisecond),
+	})
+	defer c.Shutdown(context.Background())
+
+	c.BeginMapBuilder()
+
+	waitForMatch := func(topic string, want []string) {
+		t.Helper()
+
+		var got []string
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if got = c.(*controller).TopicMap.Match(topic); reflect.DeepEqual(got, want) {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("Match %s - want: %v, got: %v", topic, want, got)
+	}
+
+	waitForMatch("orders", []string{"billing"})
+
+	// the size changes, so the edit is seen even if the modification time
+	// has not moved on
+	if err := os.WriteFile(path, []byte("orders:\n- billing\n- shipping\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForMatch("orders", []string{"billing", "shipping"})
+}
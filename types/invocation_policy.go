@@ -0,0 +1,150 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"fmt"
+	"strings"
+)
+
+// InvocationPolicy decides whether a message on a topic may invoke a
+// function, by the name returned from TopicMap.Match, i.e.
+// "function.namespace". It is checked by the Invoker before every
+// invocation, so a function cannot receive a topic's messages just by
+// adding the topic to its annotations.
+type InvocationPolicy interface {
+	// Allow returns nil when topic may invoke function, otherwise an
+	// error which is usually a *PolicyDeniedError
+	Allow(topic, function string) error
+}
+
+// PolicyRule matches topics and functions with the same wildcards as topic
+// annotations, so "payments.*" matches exactly one more segment, and
+// "payments.>" matches one or more. A wildcard must be a whole segment, so
+// a topic which uses another separator, such as "payments/refunds", is a
+// single segment. An empty pattern matches everything.
+type PolicyRule struct {
+	Topic    string
+	Function string
+}
+
+func (r PolicyRule) String() string {
+	return fmt.Sprintf("topic: %q, function: %q", r.Topic, r.Function)
+}
+
+func (r PolicyRule) matches(topic, function string) bool {
+	return matchPattern(r.Topic, topic) && matchPattern(r.Function, function)
+}
+
+// PolicyDeniedError is the error of an invocation which was not made
+// because the InvocationPolicy denied it.
+type PolicyDeniedError struct {
+	Topic    string
+	Function string
+
+	// Rule is the deny rule which matched, or nil when no allow rule
+	// matched
+	Rule *PolicyRule
+}
+
+func (e *PolicyDeniedError) Error() string {
+	if e.Rule == nil {
+		return fmt.Sprintf("invocation of %s for topic %s denied by policy, no allow rule matched", e.Function, e.Topic)
+	}
+	return fmt.Sprintf("invocation of %s for topic %s denied by policy rule %s", e.Function, e.Topic, e.Rule)
+}
+
+// RulePolicy is an InvocationPolicy built from allow and deny rules. A deny
+// rule always wins, and when there are allow rules, at least one of them
+// must match.
+type RulePolicy struct {
+	allow []PolicyRule
+	deny  []PolicyRule
+}
+
+// NewRulePolicy creates a RulePolicy, returning an error if any pattern is
+// malformed.
+func NewRulePolicy(allow, deny []PolicyRule) (*RulePolicy, error) {
+	for _, rule := range append(append([]PolicyRule{}, allow...), deny...) {
+		for _, pattern := range []string{rule.Topic, rule.Function} {
+			if err := validatePattern(pattern); err != nil {
+				return nil, fmt.Errorf("invalid policy rule %s, error: %w", rule, err)
+			}
+		}
+	}
+
+	return &RulePolicy{
+		allow: allow,
+		deny:  deny,
+	}, nil
+}
+
+// Allow implements InvocationPolicy
+func (p *RulePolicy) Allow(topic, function string) error {
+	for i := range p.deny {
+		if p.deny[i].matches(topic, function) {
+			rule := p.deny[i]
+			return &PolicyDeniedError{Topic: topic, Function: function, Rule: &rule}
+		}
+	}
+
+	if len(p.allow) == 0 {
+		return nil
+	}
+
+	for _, rule := range p.allow {
+		if rule.matches(topic, function) {
+			return nil
+		}
+	}
+
+	return &PolicyDeniedError{Topic: topic, Function: function}
+}
+
+// matchPattern matches name against a validated pattern segment by
+// segment, where an empty pattern matches everything
+func matchPattern(pattern, name string) bool {
+	if len(pattern) == 0 {
+		return true
+	}
+
+	for {
+		segment, patternRest, patternMore := strings.Cut(pattern, TopicSeparator)
+		if segment == MultiSegmentWildcard {
+			return len(name) > 0
+		}
+
+		nameSegment, nameRest, nameMore := strings.Cut(name, TopicSeparator)
+		if segment != SingleSegmentWildcard && segment != nameSegment {
+			return false
+		}
+
+		if !patternMore || !nameMore {
+			return patternMore == nameMore
+		}
+		pattern, name = patternRest, nameRest
+	}
+}
+
+// validatePattern rejects patterns which are not valid topics, and
+// wildcards which are part of a segment, such as "payments*", which would
+// otherwise only match literally
+func validatePattern(pattern string) error {
+	if len(pattern) == 0 {
+		return nil
+	}
+
+	if err := validateTopic(pattern); err != nil {
+		return err
+	}
+
+	for _, segment := range strings.Split(pattern, TopicSeparator) {
+		if segment != SingleSegmentWildcard && segment != MultiSegmentWildcard &&
+			strings.ContainsAny(segment, SingleSegmentWildcard+MultiSegmentWildcard) {
+			return fmt.Errorf("pattern %q may only use %s and %s as a whole segment", pattern, SingleSegmentWildcard, MultiSegmentWildcard)
+		}
+	}
+
+	return nil
+}
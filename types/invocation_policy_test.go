@@ -0,0 +1,189 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_RulePolicy_Allow(t *testing.T) {
+	var TestCases = []struct {
+		Name     string
+		Allow    []PolicyRule
+		Deny     []PolicyRule
+		Topic    string
+		Function string
+		Expected bool
+	}{
+		{
+			Name:     "No rules allows every invocation",
+			Topic:    "payments.refund",
+			Function: "refund.payments",
+			Expected: true,
+		},
+		{
+			Name:     "Allow rule matches",
+			Allow:    []PolicyRule{{Topic: "payments.*", Function: "*.payments"}},
+			Topic:    "payments.refund",
+			Function: "refund.payments",
+			Expected: true,
+		},
+		{
+			Name:     "No allow rule matches",
+			Allow:    []PolicyRule{{Topic: "payments.*", Function: "*.payments"}},
+			Topic:    "payments.refund",
+			Function: "exfiltrate.openfaas-fn",
+			Expected: false,
+		},
+		{
+			Name:     "Empty pattern matches any topic",
+			Allow:    []PolicyRule{{Function: "*.openfaas-fn"}},
+			Topic:    "orders.created",
+			Function: "echo.openfaas-fn",
+			Expected: true,
+		},
+		{
+			Name:     "Allow rule does not match more segments",
+			Allow:    []PolicyRule{{Topic: "payments.*", Function: "*.payments"}},
+			Topic:    "payments.admin.refund",
+			Function: "refund.payments",
+			Expected: false,
+		},
+		{
+			Name:     "Deny rule matches trailing segments",
+			Deny:     []PolicyRule{{Topic: "payments.>"}},
+			Topic:    "payments.admin.refund",
+			Function: "refund.payments",
+			Expected: false,
+		},
+		{
+			Name:     "Deny wins over allow",
+			Allow:    []PolicyRule{{Topic: "*"}},
+			Deny:     []PolicyRule{{Topic: "payments.*", Function: "*.openfaas-fn"}},
+			Topic:    "payments.refund",
+			Function: "echo.openfaas-fn",
+			Expected: false,
+		},
+	}
+
+	for _, test := range TestCases {
+		t.Run(test.Name, func(t *testing.T) {
+			policy, err := NewRulePolicy(test.Allow, test.Deny)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = policy.Allow(test.Topic, test.Function)
+			if got := err == nil; got != test.Expected {
+				t.Fatalf("Allowed - want: %t, got: %t (%v)", test.Expected, got, err)
+			}
+
+			var denied *PolicyDeniedError
+			if err != nil && !errors.As(err, &denied) {
+				t.Errorf("Error - want: *PolicyDeniedError, got: %T", err)
+			}
+		})
+	}
+}
+
+func Test_matchPattern(t *testing.T) {
+	var TestCases = []struct {
+		Pattern  string
+		Name     string
+		Expected bool
+	}{
+		{Pattern: "", Name: "payments.refunds", Expected: true},
+		{Pattern: "payments.refunds", Name: "payments.refunds", Expected: true},
+		{Pattern: "payments.refunds", Name: "payments.refunds.eu", Expected: false},
+		{Pattern: "payments.*", Name: "payments.refunds", Expected: true},
+		{Pattern: "payments.*", Name: "payments.refunds.eu", Expected: false},
+		{Pattern: "payments.*", Name: "payments", Expected: false},
+		{Pattern: "payments.>", Name: "payments.refunds.eu", Expected: true},
+		{Pattern: "payments.>", Name: "payments", Expected: false},
+		{Pattern: "*.payments", Name: "refund.payments", Expected: true},
+		{Pattern: "*.payments", Name: "refund.payments-canary", Expected: false},
+		{Pattern: "*", Name: "payments/refunds/eu", Expected: true},
+		{Pattern: "*", Name: "payments.refunds", Expected: false},
+		{Pattern: ">", Name: "payments.refunds", Expected: true},
+	}
+
+	for _, test := range TestCases {
+		t.Run(test.Pattern+" "+test.Name, func(t *testing.T) {
+			if got := matchPattern(test.Pattern, test.Name); got != test.Expected {
+				t.Errorf("Match - want: %t, got: %t", test.Expected, got)
+			}
+		})
+	}
+}
+
+func Test_NewRulePolicy_InvalidPattern(t *testing.T) {
+	for _, pattern := range []string{"payments*", "payments.>.eu", "payments..refunds", "pay*ments.refunds"} {
+		if _, err := NewRulePolicy(nil, []PolicyRule{{Topic: pattern}}); err == nil {
+			t.Errorf("Error for %q - want: invalid pattern, got: nil", pattern)
+		}
+	}
+}
+
+func Test_Invoker_DeniedByPolicy(t *testing.T) {
+	var requests int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	policy, err := NewRulePolicy(nil, []PolicyRule{{Topic: "payments.*", Function: "*.openfaas-fn"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink := NewMemoryDeadLetterSink(0)
+	c := NewController(nil, &ControllerConfig{
+		GatewayURL:       srv.URL,
+		UpstreamTimeout:  time.Second,
+		DeadLetterSink:   sink,
+		CircuitBreaker:   &CircuitBreakerConfig{FailureThreshold: 1, OpenTimeout: time.Minute},
+		InvocationPolicy: policy,
+	})
+
+	lookup := map[string][]string{"payments.refund": {"refund.payments", "echo.openfaas-fn"}}
+	c.(*controller).TopicMap.Sync(&lookup)
+
+	body := []byte("hello")
+	responses, err := c.InvokeAndWait(context.Background(), "payments.refund", &body, http.Header{})
+	if err != nil {
+		t.Errorf("InvokeAndWait - want: no error, got: %s", err)
+	}
+
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Errorf("Requests - want: %d, got: %d", 1, got)
+	}
+
+	if responses[0].Outcome != OutcomeSucceeded {
+		t.Errorf("Outcome allowed - want: %s, got: %s", OutcomeSucceeded, responses[0].Outcome)
+	}
+	if responses[1].Outcome != OutcomeDenied {
+		t.Errorf("Outcome denied - want: %s, got: %s", OutcomeDenied, responses[1].Outcome)
+	}
+
+	var denied *PolicyDeniedError
+	if !errors.As(responses[1].Error, &denied) || denied.Function != "echo.openfaas-fn" || denied.Rule == nil {
+		t.Errorf("Error - want: *PolicyDeniedError for %s, got: %v", "echo.openfaas-fn", responses[1].Error)
+	}
+
+	if state := c.(*controller).Invoker.CircuitBreaker.State("echo.openfaas-fn"); state != CircuitClosed {
+		t.Errorf("Circuit - want: %s, got: %s", CircuitClosed, state)
+	}
+
+	if letters, _ := sink.Drain(context.Background()); len(letters) != 0 {
+		t.Errorf("Dead letters - want: %d, got: %d", 0, len(letters))
+	}
+}
@@ -4,12 +4,12 @@
 package types
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 )
 
@@ -23,8 +23,70 @@ type Invoker struct {
 	ContentType   string
 	Responses     chan InvokerResponse
 	UserAgent     string
+
+	// MaxInFlight limits the number of invocations in flight across all
+	// topics, zero means no limit.
+	MaxInFlight int
+
+	// FanOut is the number of matched functions invoked in parallel for a
+	// single message, zero or one invokes them one after another.
+	FanOut int
+
+	// RetryPolicy retries failed invocations, nil disables retries.
+	RetryPolicy *RetryPolicy
+
+	// CircuitBreaker short-circuits invocations of failing functions,
+	// nil disables it.
+	CircuitBreaker *CircuitBreaker
+
+	// Policy decides whether a topic may invoke each matched function,
+	// nil allows every invocation.
+	Policy InvocationPolicy
+
+	// DeadLetters receives messages whose invocation finally failed, nil
+	// disables dead-lettering.
+	DeadLetters DeadLetterSink
+
+	// MaxResponseBodyBytes limits how much of each response body is read,
+	// zero means no limit.
+	MaxResponseBodyBytes int64
+
+	// Middleware wraps each request to a function, the first being the
+	// outermost. The built-in User-Agent, X-Topic and X-Connector
+	// middleware always run first.
+	Middleware []Middleware
+
+	pool     *workerPool
+	poolOnce sync.Once
+
+	middlewareLock sync.RWMutex
 }
 
+// InvocationOutcome is the final result of invoking a function, after any retries
+type InvocationOutcome string
+
+const (
+	// OutcomeSucceeded the function returned a 2xx status code
+	OutcomeSucceeded InvocationOutcome = "succeeded"
+
+	// OutcomeFailed the invocation failed in a way the RetryPolicy does not retry
+	OutcomeFailed InvocationOutcome = "failed"
+
+	// OutcomeRetriesExhausted the invocation was still failing after RetryPolicy.MaxAttempts
+	OutcomeRetriesExhausted InvocationOutcome = "retries_exhausted"
+
+	// OutcomeCancelled the caller's context was done before the invocation completed
+	OutcomeCancelled InvocationOutcome = "cancelled"
+
+	// OutcomeShortCircuited the function was not invoked because its circuit is open,
+	// the Error field holds a *CircuitOpenError
+	OutcomeShortCircuited InvocationOutcome = "short_circuited"
+
+	// OutcomeDenied the function was not invoked because the InvocationPolicy denied it,
+	// the Error field holds the policy's error, usually a *PolicyDeniedError
+	OutcomeDenied InvocationOutcome = "denied"
+)
+
 // InvokerResponse is a wrapper to contain the response or error the Invoker
 // receives from the function. Networking errors wil be found in the Error field.
 type InvokerResponse struct {
@@ -36,6 +98,18 @@ type InvokerResponse struct {
 	Topic    string
 	Function string
 	Duration time.Duration
+
+	// Attempts is the number of requests made to the function
+	Attempts int
+
+	// Outcome is the final result of the invocation
+	Outcome InvocationOutcome
+
+	// Message is the message which was published to the function
+	Message *Message
+
+	// Truncated is true when Body was cut short at MaxResponseBodyBytes
+	Truncated bool
 }
 
 // NewInvoker constructs an Invoker instance
@@ -47,76 +121,342 @@ func NewInvoker(gatewayURL string, client *http.Client, contentType string, prin
 		GatewayURL:    gatewayURL,
 		ContentType:   contentType,
 		Responses:     make(chan InvokerResponse),
+		UserAgent:     userAgent,
 	}
 }
 
+// Use adds middleware to the end of the chain which wraps each request to
+// a function. It is safe to call while functions are being invoked.
+func (i *Invoker) Use(middleware ...Middleware) {
+	i.middlewareLock.Lock()
+	defer i.middlewareLock.Unlock()
+
+	i.Middleware = append(i.Middleware[:len(i.Middleware):len(i.Middleware)], middleware...)
+}
+
 // Invoke triggers a function by accessing the API Gateway
 func (i *Invoker) Invoke(topicMap *TopicMap, topic string, message *[]byte, headers http.Header) {
 	i.InvokeWithContext(context.Background(), topicMap, topic, message, headers)
 }
 
-// InvokeWithContext triggers a function by accessing the API Gateway while propagating context
+// InvokeWithContext triggers a function by accessing the API Gateway while propagating context.
+// Matched functions are invoked according to FanOut and MaxInFlight, and
+// any which have not started by the time ctx is done are reported with
+// the context's error instead. It returns once every matched function has
+// been reported on the Responses channel.
 func (i *Invoker) InvokeWithContext(ctx context.Context, topicMap *TopicMap, topic string, message *[]byte, headers http.Header) {
-	if len(*message) == 0 {
-		i.Responses <- InvokerResponse{
+	i.Publish(ctx, topicMap, newMessage(topic, message, headers))
+}
+
+// InvokeAndWait behaves like InvokeWithContext and also returns the
+// response of every matched function, in the order returned by
+// TopicMap.Match. The responses are still sent on the Responses channel.
+func (i *Invoker) InvokeAndWait(ctx context.Context, topicMap *TopicMap, topic string, message *[]byte, headers http.Header) []InvokerResponse {
+	return i.Publish(ctx, topicMap, newMessage(topic, message, headers))
+}
+
+// Publish invokes the functions which match the topic of msg in the same
+// way as InvokeAndWait. Each response refers back to msg.
+//
+// When msg.BodyReader matches several functions, the stream is copied to
+// all of them at once, so they are invoked concurrently regardless of
+// FanOut and MaxInFlight.
+func (i *Invoker) Publish(ctx context.Context, topicMap *TopicMap, msg *Message) []InvokerResponse {
+	if !msg.hasBody() {
+		res := InvokerResponse{
 			Context:  ctx,
 			Error:    fmt.Errorf("no message to send"),
+			Topic:    msg.Topic,
 			Duration: time.Millisecond * 0,
+			Outcome:  OutcomeFailed,
+			Message:  msg,
 		}
+		i.Responses <- res
+		return []InvokerResponse{res}
 	}
 
-	matchedFunctions := topicMap.Match(topic)
-	for _, matchedFunction := range matchedFunctions {
-		log.Printf("[connector] Invoke: %s", matchedFunction)
+	matchedFunctions := topicMap.Match(msg.Topic)
+	responses := make([]InvokerResponse, len(matchedFunctions))
 
-		gwURL := fmt.Sprintf("%s/%s", i.GatewayURL, matchedFunction)
-		reader := bytes.NewReader(*message)
+	bodies, shared := msg.requestBodies(len(matchedFunctions))
+
+	pool, parallelism := i.workerPool(), i.FanOut
+	if shared {
+		pool, parallelism = nil, len(matchedFunctions)
+	}
+
+	fanOut(ctx, pool, parallelism, len(matchedFunctions),
+		func(n int) {
+			var options *FunctionOptions
+			if function, ok := topicMap.Function(matchedFunctions[n]); ok {
+				options = &function.Options
+			}
 
-		if i.PrintRequest {
-			log.Printf("[connector] %s => %s body:\t%s", topic, matchedFunction, string(*message))
+			responses[n] = i.invokeFunction(ctx, matchedFunctions[n], options, msg, bodies[n])
+			bodies[n].close()
+
+			i.Responses <- responses[n]
+		},
+		func(n int, err error) {
+			bodies[n].close()
+
+			responses[n] = InvokerResponse{
+				Context:  ctx,
+				Error:    fmt.Errorf("unable to invoke %s, error: %w", matchedFunctions[n], err),
+				Function: matchedFunctions[n],
+				Topic:    msg.Topic,
+				Outcome:  OutcomeCancelled,
+				Message:  msg,
+			}
+			i.Responses <- responses[n]
+		})
+
+	return responses
+}
+
+// workerPool returns the pool which limits invocations to MaxInFlight
+func (i *Invoker) workerPool() *workerPool {
+	i.poolOnce.Do(func() {
+		i.pool = newWorkerPool(i.MaxInFlight)
+	})
+	return i.pool
+}
+
+// redrive invokes a single function with msg, as if it had matched the
+// topic of msg, and reports the response on the Responses channel. A
+// failure is not written to the DeadLetters sink, which is left to the
+// caller.
+func (i *Invoker) redrive(ctx context.Context, topicMap *TopicMap, function string, msg *Message) InvokerResponse {
+	res := InvokerResponse{
+		Context:  ctx,
+		Error:    fmt.Errorf("no message to send"),
+		Function: function,
+		Topic:    msg.Topic,
+		Outcome:  OutcomeFailed,
+		Message:  msg,
+	}
+
+	if msg.hasBody() {
+		fanOut(ctx, i.workerPool(), 1, 1,
+			func(int) {
+				var options *FunctionOptions
+				if metadata, ok := topicMap.Function(function); ok {
+					options = &metadata.Options
+				}
+
+				bodies, _ := msg.requestBodies(1)
+				res = i.invokeAllowed(ctx, function, options, msg, bodies[0])
+				bodies[0].close()
+			},
+			func(_ int, err error) {
+				res.Error = fmt.Errorf("unable to invoke %s, error: %w", function, err)
+				res.Outcome = OutcomeCancelled
+			})
+	}
+
+	i.Responses <- res
+	return res
+}
+
+// invokeFunction invokes a single matched function with invokeAllowed, and
+// writes the message to the DeadLetters sink if it finally fails. options
+// override the Invoker's settings for the function, if not nil.
+func (i *Invoker) invokeFunction(ctx context.Context, matchedFunction string, options *FunctionOptions, msg *Message, body *requestBody) InvokerResponse {
+	start := time.Now()
+
+	res := i.invokeAllowed(ctx, matchedFunction, options, msg, body)
+
+	switch res.Outcome {
+	case OutcomeFailed, OutcomeRetriesExhausted, OutcomeShortCircuited:
+		if i.DeadLetters != nil {
+			letter := newDeadLetter(res, msg, start)
+			if err := i.DeadLetters.Write(ctx, letter); err != nil {
+				log.Printf("[connector] unable to write dead letter for %s, error: %s", matchedFunction, err)
+			}
 		}
+	}
 
-		start := time.Now()
-		body, statusCode, header, err := i.invoke(ctx, i.Client, gwURL, i.ContentType, topic, reader, headers)
-		if err != nil {
-			i.Responses <- InvokerResponse{
+	return res
+}
+
+// invokeAllowed invokes a single matched function, unless the Policy
+// denies it or its circuit is open.
+func (i *Invoker) invokeAllowed(ctx context.Context, matchedFunction string, options *FunctionOptions, msg *Message, body *requestBody) InvokerResponse {
+	if i.Policy != nil {
+		if err := i.Policy.Allow(msg.Topic, matchedFunction); err != nil {
+			log.Printf("[connector] Denied: %s for topic %s, error: %s", matchedFunction, msg.Topic, err)
+
+			return InvokerResponse{
 				Context:  ctx,
-				Error:    fmt.Errorf("unable to invoke %s, error: %w", matchedFunction, err),
-				Duration: time.Since(start),
+				Error:    err,
+				Function: matchedFunction,
+				Topic:    msg.Topic,
+				Outcome:  OutcomeDenied,
+				Message:  msg,
 			}
-			continue
 		}
+	}
+
+	return i.invokeWithBreaker(ctx, matchedFunction, options, msg, body)
+}
 
-		i.Responses <- InvokerResponse{
+// invokeWithBreaker invokes a single matched function, unless its circuit
+// is open, and reports the result to the CircuitBreaker.
+func (i *Invoker) invokeWithBreaker(ctx context.Context, matchedFunction string, options *FunctionOptions, msg *Message, body *requestBody) InvokerResponse {
+	if err := i.CircuitBreaker.Allow(matchedFunction); err != nil {
+		return InvokerResponse{
 			Context:  ctx,
-			Body:     body,
-			Status:   statusCode,
-			Header:   header,
+			Error:    err,
 			Function: matchedFunction,
-			Topic:    topic,
-			Duration: time.Since(start),
+			Topic:    msg.Topic,
+			Outcome:  OutcomeShortCircuited,
+			Message:  msg,
 		}
 	}
+
+	res := i.invokeWithRetries(ctx, matchedFunction, options, msg, body)
+
+	if res.Outcome == OutcomeCancelled {
+		i.CircuitBreaker.Release(matchedFunction)
+	} else {
+		i.CircuitBreaker.Record(matchedFunction, res.Error == nil && res.Status < http.StatusInternalServerError)
+	}
+
+	return res
 }
 
-func (i *Invoker) invoke(ctx context.Context, c *http.Client, gwURL, contentType, topic string, reader io.Reader, headers http.Header) (*[]byte, int, *http.Header, error) {
-	req, err := http.NewRequest(http.MethodPost, gwURL, reader)
-	if err != nil {
-		return nil, http.StatusServiceUnavailable, nil, err
+// invokeWithRetries invokes a single matched function, retrying according
+// to the RetryPolicy when body can be replayed, and wraps the final result
+// as an InvokerResponse.
+func (i *Invoker) invokeWithRetries(ctx context.Context, matchedFunction string, options *FunctionOptions, msg *Message, body *requestBody) InvokerResponse {
+	log.Printf("[connector] Invoke: %s", matchedFunction)
+
+	gwURL := fmt.Sprintf("%s/%s", options.route(i.GatewayURL), matchedFunction)
+	retryPolicy := options.retryPolicy(i.RetryPolicy)
+
+	if i.PrintRequest {
+		if msg.BodyReader != nil || msg.GetBody != nil {
+			log.Printf("[connector] %s => %s body:\t(streamed)", msg.Topic, matchedFunction)
+		} else {
+			log.Printf("[connector] %s => %s body:\t%s", msg.Topic, matchedFunction, string(msg.Body))
+		}
 	}
 
-	req.Header.Set("User-Agent", i.UserAgent)
+	start := time.Now()
 
-	if contentType != "" {
-		req.Header.Set("Content-Type", contentType)
+	var res InvokerResponse
+	for attempt := 1; ; attempt++ {
+		res = InvokerResponse{
+			Context:  ctx,
+			Function: matchedFunction,
+			Topic:    msg.Topic,
+			Attempts: attempt,
+			Message:  msg,
+		}
+
+		var httpRes *http.Response
+		reader, err := body.open()
+		if err == nil {
+			invocation := &Invocation{
+				Topic:    msg.Topic,
+				Function: matchedFunction,
+				Attempt:  attempt,
+				Message:  msg,
+			}
+			httpRes, err = i.invokeWithOptions(ctx, options, gwURL, invocation, reader, msg.Header)
+		}
+
+		statusCode := 0
+		if err != nil {
+			res.Error = fmt.Errorf("unable to invoke %s, error: %w", matchedFunction, err)
+		} else {
+			statusCode = httpRes.StatusCode
+			res.Status = statusCode
+			res.Header = &httpRes.Header
+		}
+
+		succeeded := err == nil && statusCode >= 200 && statusCode < 300
+		retry := !succeeded && ctx.Err() == nil && body.replayable &&
+			retryPolicy.shouldRetry(attempt, statusCode, err)
+
+		if httpRes != nil {
+			if retry {
+				discardBody(httpRes.Body)
+			} else if err := i.readBody(&res, httpRes.Body); err != nil {
+				res.Error = err
+				succeeded = false
+			}
+		}
+
+		switch {
+		case succeeded:
+			res.Outcome = OutcomeSucceeded
+		case ctx.Err() != nil:
+			res.Outcome = OutcomeCancelled
+		case !retry:
+			res.Outcome = OutcomeFailed
+			if attempt > 1 && retryPolicy.retryable(statusCode, err) {
+				res.Outcome = OutcomeRetriesExhausted
+			}
+		}
+
+		if !retry {
+			break
+		}
+
+		delay := retryPolicy.backoff(attempt, res.Header)
+		log.Printf("[connector] Retry: %s in %s, attempt %d of %d", matchedFunction, delay, attempt+1, retryPolicy.MaxAttempts)
+
+		if err := sleepContext(ctx, delay); err != nil {
+			res.Outcome = OutcomeCancelled
+			break
+		}
+	}
+
+	res.Duration = time.Since(start)
+	return res
+}
+
+// invokeWithOptions makes a single request to the function, applying any
+// Timeout, ContentType and Queue from options.
+func (i *Invoker) invokeWithOptions(ctx context.Context, options *FunctionOptions, gwURL string, invocation *Invocation, reader io.Reader, headers http.Header) (*http.Response, error) {
+	if options == nil {
+		return i.invoke(ctx, i.Client, gwURL, i.ContentType, invocation, reader, headers)
+	}
+
+	client, contentType := i.Client, i.ContentType
+	if len(options.ContentType) > 0 {
+		contentType = options.ContentType
 	}
 
-	if v := req.Header.Get("X-Connector"); v == "" {
-		req.Header.Set("X-Connector", "connector-sdk")
+	if options.Timeout > 0 {
+		// the client's own Timeout would otherwise cap a longer timeout
+		withTimeout := *client
+		withTimeout.Timeout = options.Timeout
+		client = &withTimeout
 	}
 
-	if v := req.Header.Get("X-Topic"); v == "" {
-		req.Header.Set("X-Topic", topic)
+	if len(options.Queue) > 0 {
+		headers = headers.Clone()
+		if headers == nil {
+			headers = http.Header{}
+		}
+		headers.Set(QueueNameHeader, options.Queue)
+	}
+
+	return i.invoke(ctx, client, gwURL, contentType, invocation, reader, headers)
+}
+
+// invoke makes a single request to the function through the middleware
+// chain.
+func (i *Invoker) invoke(ctx context.Context, c *http.Client, gwURL, contentType string, invocation *Invocation, reader io.Reader, headers http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, gwURL, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
 	}
 
 	for k, values := range headers {
@@ -125,29 +465,81 @@ func (i *Invoker) invoke(ctx context.Context, c *http.Client, gwURL, contentType
 		}
 	}
 
-	req = req.WithContext(ctx)
 	if req.Body != nil {
 		defer req.Body.Close()
 	}
 
-	var body *[]byte
-	res, err := c.Do(req)
+	invocation.Request = req
+
+	res, err := i.roundTrip(c)(invocation)
 	if err != nil {
-		return nil, http.StatusServiceUnavailable, nil,
-			fmt.Errorf("unable to reach endpoint %s, error: %w", gwURL, err)
+		return nil, fmt.Errorf("unable to reach endpoint %s, error: %w", gwURL, err)
+	}
+	if res == nil {
+		return nil, fmt.Errorf("unable to reach endpoint %s, error: no response from middleware", gwURL)
 	}
 
-	if res.Body != nil {
-		defer res.Body.Close()
+	return res, nil
+}
 
-		bytesOut, err := io.ReadAll(res.Body)
-		if err != nil {
-			return nil, http.StatusServiceUnavailable,
-				nil,
-				fmt.Errorf("unable to read body from response %w", err)
+// roundTrip returns the middleware chain which sends requests with c
+func (i *Invoker) roundTrip(c *http.Client) RoundTripFunc {
+	i.middlewareLock.RLock()
+	middleware := i.Middleware
+	i.middlewareLock.RUnlock()
+
+	send := func(invocation *Invocation) (*http.Response, error) {
+		return c.Do(invocation.Request)
+	}
+
+	return chain(chain(send, middleware...),
+		UserAgentMiddleware(i.UserAgent),
+		TopicHeaderMiddleware(),
+		ConnectorHeaderMiddleware("connector-sdk"))
+}
+
+// readBody reads the response body into res.Body, up to
+// MaxResponseBodyBytes, or passes it to the message's StreamResponse
+// function. The body is always closed.
+func (i *Invoker) readBody(res *InvokerResponse, body io.ReadCloser) error {
+	defer body.Close()
+
+	limit := i.MaxResponseBodyBytes
+
+	if res.Message.StreamResponse != nil {
+		var reader io.Reader = body
+		if limit > 0 {
+			reader = io.LimitReader(body, limit)
+		}
+
+		if err := res.Message.StreamResponse(*res, reader); err != nil {
+			return fmt.Errorf("unable to stream body from response %w", err)
 		}
-		body = &bytesOut
+		return nil
+	}
+
+	var reader io.Reader = body
+	if limit > 0 {
+		reader = io.LimitReader(body, limit+1)
+	}
+
+	bytesOut, err := io.ReadAll(reader)
+	if err != nil {
+		return fmt.Errorf("unable to read body from response %w", err)
 	}
 
-	return body, res.StatusCode, &res.Header, err
+	if limit > 0 && int64(len(bytesOut)) > limit {
+		bytesOut = bytesOut[:limit]
+		res.Truncated = true
+	}
+
+	res.Body = &bytesOut
+	return nil
+}
+
+// discardBody reads a little of a response body which is not needed so
+// that the connection can be re-used, then closes it.
+func discardBody(body io.ReadCloser) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(body, 4096))
+	body.Close()
 }
@@ -0,0 +1,372 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// collectResponses drains invoker.Responses until the returned function
+// is called, which returns every response received.
+func collectResponses(invoker *Invoker) func() []InvokerResponse {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	var responses []InvokerResponse
+
+	go func() {
+		defer close(finished)
+		for {
+			select {
+			case res := <-invoker.Responses:
+				responses = append(responses, res)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() []InvokerResponse {
+		close(done)
+		<-finished
+		return responses
+	}
+}
+
+func Test_InvokeWithContext_FanOut(t *testing.T) {
+	var inFlight, maxInFlight int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	var TestCases = []struct {
+		Name        string
+		FanOut      int
+		MaxInFlight int
+		Expected    int32
+	}{
+		{Name: "Sequential", FanOut: 0, MaxInFlight: 0, Expected: 1},
+		{Name: "Fan-out", FanOut: 4, MaxInFlight: 0, Expected: 4},
+		{Name: "Fan-out limited by MaxInFlight", FanOut: 4, MaxInFlight: 2, Expected: 2},
+	}
+
+	for _, test := range TestCases {
+		t.Run(test.Name, func(t *testing.T) {
+			atomic.StoreInt32(&maxInFlight, 0)
+
+			lookup := map[string][]string{"topic1": {"fn1", "fn2", "fn3", "fn4"}}
+			topicMap := NewTopicMap()
+			topicMap.Sync(&lookup)
+
+			invoker := NewInvoker(srv.URL, srv.Client(), "", false, false, "")
+			invoker.FanOut = test.FanOut
+			invoker.MaxInFlight = test.MaxInFlight
+
+			stop := collectResponses(invoker)
+
+			body := []byte("hello")
+			invoker.InvokeWithContext(context.Background(), &topicMap, "topic1", &body, http.Header{})
+
+			responses := stop()
+			if len(responses) != 4 {
+				t.Fatalf("Responses - want: %d, got: %d", 4, len(responses))
+			}
+			for _, res := range responses {
+				if res.Error != nil || res.Status != http.StatusOK {
+					t.Errorf("Response for %s - want: %d, got: %d, error: %v", res.Function, http.StatusOK, res.Status, res.Error)
+				}
+			}
+
+			if got := atomic.LoadInt32(&maxInFlight); got != test.Expected {
+				t.Errorf("Max in-flight - want: %d, got: %d", test.Expected, got)
+			}
+		})
+	}
+}
+
+func Test_InvokeWithContext_StopsWhenCancelled(t *testing.T) {
+	var calls int32
+	ctx, cancel := context.WithCancel(context.Background())
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		cancel()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	lookup := map[string][]string{"topic1": {"fn1", "fn2", "fn3"}}
+	topicMap := NewTopicMap()
+	topicMap.Sync(&lookup)
+
+	invoker := NewInvoker(srv.URL, srv.Client(), "", false, false, "")
+	stop := collectResponses(invoker)
+
+	body := []byte("hello")
+	invoker.InvokeWithContext(ctx, &topicMap, "topic1", &body, http.Header{})
+
+	responses := stop()
+	if len(responses) != 3 {
+		t.Fatalf("Responses - want: %d, got: %d", 3, len(responses))
+	}
+
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("Calls - want: %d, got: %d", 1, got)
+	}
+
+	cancelled := 0
+	for _, res := range responses {
+		if errors.Is(res.Error, context.Canceled) {
+			cancelled++
+		}
+	}
+	// the first invocation may also observe the cancellation
+	if cancelled < 2 {
+		t.Errorf("Cancelled responses - want: at least %d, got: %d", 2, cancelled)
+	}
+}
+
+func Test_InvokeWithContext_Retries(t *testing.T) {
+	var TestCases = []struct {
+		Name             string
+		Statuses         []int
+		Policy           *RetryPolicy
+		ExpectedAttempts int
+		ExpectedStatus   int
+		ExpectedOutcome  InvocationOutcome
+	}{
+		{
+			Name:             "No policy",
+			Statuses:         []int{http.StatusServiceUnavailable},
+			ExpectedAttempts: 1,
+			ExpectedStatus:   http.StatusServiceUnavailable,
+			ExpectedOutcome:  OutcomeFailed,
+		},
+		{
+			Name:             "Succeeds after retry",
+			Statuses:         []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusOK},
+			Policy:           &RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Millisecond},
+			ExpectedAttempts: 3,
+			ExpectedStatus:   http.StatusOK,
+			ExpectedOutcome:  OutcomeSucceeded,
+		},
+		{
+			Name:             "Retries exhausted",
+			Statuses:         []int{http.StatusGatewayTimeout, http.StatusGatewayTimeout},
+			Policy:           &RetryPolicy{MaxAttempts: 2, BaseBackoff: time.Millisecond},
+			ExpectedAttempts: 2,
+			ExpectedStatus:   http.StatusGatewayTimeout,
+			ExpectedOutcome:  OutcomeRetriesExhausted,
+		},
+		{
+			Name:             "Status code not retryable",
+			Statuses:         []int{http.StatusInternalServerError},
+			Policy:           &RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Millisecond},
+			ExpectedAttempts: 1,
+			ExpectedStatus:   http.StatusInternalServerError,
+			ExpectedOutcome:  OutcomeFailed,
+		},
+	}
+
+	for _, test := range TestCases {
+		t.Run(test.Name, func(t *testing.T) {
+			var calls int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&calls, 1)
+				w.WriteHeader(test.Statuses[int(n)-1])
+			}))
+			defer srv.Close()
+
+			lookup := map[string][]string{"topic1": {"fn1"}}
+			topicMap := NewTopicMap()
+			topicMap.Sync(&lookup)
+
+			invoker := NewInvoker(srv.URL, srv.Client(), "", false, false, "")
+			invoker.RetryPolicy = test.Policy
+			stop := collectResponses(invoker)
+
+			body := []byte("hello")
+			invoker.InvokeWithContext(context.Background(), &topicMap, "topic1", &body, http.Header{})
+
+			responses := stop()
+			if len(responses) != 1 {
+				t.Fatalf("Responses - want: %d, got: %d", 1, len(responses))
+			}
+
+			res := responses[0]
+			if res.Attempts != test.ExpectedAttempts {
+				t.Errorf("Attempts - want: %d, got: %d", test.ExpectedAttempts, res.Attempts)
+			}
+			if res.Status != test.ExpectedStatus {
+				t.Errorf("Status - want: %d, got: %d", test.ExpectedStatus, res.Status)
+			}
+			if res.Outcome != test.ExpectedOutcome {
+				t.Errorf("Outcome - want: %s, got: %s", test.ExpectedOutcome, res.Outcome)
+			}
+		})
+	}
+}
+
+func Test_RetryPolicy_backoff(t *testing.T) {
+	policy := &RetryPolicy{
+		BaseBackoff: 100 * time.Millisecond,
+		MaxBackoff:  time.Second,
+	}
+
+	var TestCases = []struct {
+		Name     string
+		Attempt  int
+		Header   http.Header
+		Expected time.Duration
+	}{
+		{Name: "First retry", Attempt: 1, Expected: 100 * time.Millisecond},
+		{Name: "Third retry", Attempt: 3, Expected: 400 * time.Millisecond},
+		{Name: "Capped by MaxBackoff", Attempt: 10, Expected: time.Second},
+		{Name: "Retry-After seconds", Attempt: 1, Header: http.Header{"Retry-After": {"0"}}, Expected: 0},
+		{Name: "Retry-After capped by MaxBackoff", Attempt: 1, Header: http.Header{"Retry-After": {"120"}}, Expected: time.Second},
+	}
+
+	for _, test := range TestCases {
+		header := test.Header
+		if got := policy.backoff(test.Attempt, &header); got != test.Expected {
+			t.Errorf("%s - want: %s, got: %s", test.Name, test.Expected, got)
+		}
+	}
+}
+
+func Test_Publish_StreamsBodyReaderToEachFunction(t *testing.T) {
+	var received sync.Map
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received.Store(r.URL.Path, string(body))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	lookup := map[string][]string{"topic1": {"fn1", "fn2", "fn3"}}
+	topicMap := NewTopicMap()
+	topicMap.Sync(&lookup)
+
+	invoker := NewInvoker(srv.URL, srv.Client(), "", false, false, "")
+	stop := collectResponses(invoker)
+
+	payload := strings.Repeat("0123456789", 100000)
+	responses := invoker.Publish(context.Background(), &topicMap, &Message{
+		Topic:      "topic1",
+		BodyReader: strings.NewReader(payload),
+	})
+	stop()
+
+	for _, res := range responses {
+		if res.Outcome != OutcomeSucceeded {
+			t.Errorf("Outcome for %s - want: %s, got: %s, error: %v", res.Function, OutcomeSucceeded, res.Outcome, res.Error)
+		}
+	}
+
+	for _, fn := range []string{"fn1", "fn2", "fn3"} {
+		body, _ := received.Load("/" + fn)
+		if body != payload {
+			t.Errorf("Body for %s - want: %d bytes, got: %d bytes", fn, len(payload), len(body.(string)))
+		}
+	}
+}
+
+func Test_Publish_RetriesGetBody(t *testing.T) {
+	var calls int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if atomic.AddInt32(&calls, 1) == 1 || string(body) != "hello" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	lookup := map[string][]string{"topic1": {"fn1"}}
+	topicMap := NewTopicMap()
+	topicMap.Sync(&lookup)
+
+	invoker := NewInvoker(srv.URL, srv.Client(), "", false, false, "")
+	invoker.RetryPolicy = &RetryPolicy{MaxAttempts: 2}
+	stop := collectResponses(invoker)
+
+	responses := invoker.Publish(context.Background(), &topicMap, &Message{
+		Topic: "topic1",
+		GetBody: func() (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader("hello")), nil
+		},
+	})
+	stop()
+
+	if responses[0].Outcome != OutcomeSucceeded || responses[0].Attempts != 2 {
+		t.Errorf("Response - want: %s after %d attempts, got: %s after %d attempts", OutcomeSucceeded, 2, responses[0].Outcome, responses[0].Attempts)
+	}
+}
+
+func Test_Publish_ResponseBodyLimitAndStreaming(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("0123456789"))
+	}))
+	defer srv.Close()
+
+	lookup := map[string][]string{"topic1": {"fn1"}}
+	topicMap := NewTopicMap()
+	topicMap.Sync(&lookup)
+
+	invoker := NewInvoker(srv.URL, srv.Client(), "", false, false, "")
+	invoker.MaxResponseBodyBytes = 4
+	stop := collectResponses(invoker)
+	defer stop()
+
+	responses := invoker.Publish(context.Background(), &topicMap, &Message{
+		Topic: "topic1",
+		Body:  []byte("hello"),
+	})
+
+	if got := string(*responses[0].Body); got != "0123" || !responses[0].Truncated {
+		t.Errorf("Body - want: %q truncated, got: %q truncated: %t", "0123", got, responses[0].Truncated)
+	}
+
+	var streamed []byte
+	responses = invoker.Publish(context.Background(), &topicMap, &Message{
+		Topic: "topic1",
+		Body:  []byte("hello"),
+		StreamResponse: func(res InvokerResponse, body io.Reader) error {
+			var err error
+			streamed, err = io.ReadAll(body)
+			return err
+		},
+	})
+
+	if responses[0].Body != nil {
+		t.Errorf("Body - want: nil when streamed, got: %q", string(*responses[0].Body))
+	}
+	if string(streamed) != "0123" {
+		t.Errorf("Streamed body - want: %q, got: %q", "0123", string(streamed))
+	}
+}
@@ -9,8 +9,55 @@ import (
 	"time"
 )
 
+// TransportConfig tunes the connections made by MakeClientWithTransport.
+// Zero values keep the defaults of MakeClient.
+type TransportConfig struct {
+	// DialTimeout limits how long a connection takes to establish,
+	// the client's timeout if zero.
+	DialTimeout time.Duration
+
+	// KeepAlive is the interval of TCP keep-alive probes, 10s if zero.
+	KeepAlive time.Duration
+
+	// TLSHandshakeTimeout limits how long a TLS handshake takes, no limit
+	// if zero.
+	TLSHandshakeTimeout time.Duration
+
+	// ResponseHeaderTimeout limits how long to wait for the response
+	// headers once the request is written, no limit if zero.
+	ResponseHeaderTimeout time.Duration
+
+	// IdleConnTimeout is how long an idle connection is kept open for
+	// re-use, 120ms if zero.
+	IdleConnTimeout time.Duration
+
+	// MaxIdleConns and MaxIdleConnsPerHost limit the number of idle
+	// connections kept open, 100 if zero.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+
+	// MaxConnsPerHost limits the connections to each host, including
+	// those in use, no limit if zero.
+	MaxConnsPerHost int
+
+	// EnableHTTP2 negotiates HTTP/2 with gateways which support it over
+	// TLS, otherwise HTTP/1.1 is used.
+	EnableHTTP2 bool
+}
+
 // MakeClient returns a http.Client with a timeout for connection establishing and request handling
 func MakeClient(timeout time.Duration) *http.Client {
+	return MakeClientWithTransport(timeout, TransportConfig{})
+}
+
+// MakeClientWithTransport returns a http.Client like MakeClient, with the
+// connections tuned by config.
+func MakeClientWithTransport(timeout time.Duration, config TransportConfig) *http.Client {
+	dialTimeout := config.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = timeout
+	}
+
 	return &http.Client{
 		Transport: &http.Transport{
 			Proxy: http.ProxyFromEnvironment,
@@ -18,12 +65,16 @@ func MakeClient(timeout time.Duration) *http.Client {
 				// Timeout is the maximum amount of time a dial will wait for
 				// a connect to complete. If Deadline is also set, it may fail
 				// earlier.
-				Timeout:   timeout,
-				KeepAlive: 10 * time.Second,
+				Timeout:   dialTimeout,
+				KeepAlive: durationOrDefault(config.KeepAlive, 10*time.Second),
 			}).DialContext,
-			MaxIdleConns:        100,
-			MaxIdleConnsPerHost: 100,
-			IdleConnTimeout:     120 * time.Millisecond,
+			TLSHandshakeTimeout:   config.TLSHandshakeTimeout,
+			ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+			MaxIdleConns:          intOrDefault(config.MaxIdleConns, 100),
+			MaxIdleConnsPerHost:   intOrDefault(config.MaxIdleConnsPerHost, 100),
+			MaxConnsPerHost:       config.MaxConnsPerHost,
+			IdleConnTimeout:       durationOrDefault(config.IdleConnTimeout, 120*time.Millisecond),
+			ForceAttemptHTTP2:     config.EnableHTTP2,
 		},
 		// Timeout specifies a time limit for requests made by this
 		// Client. The timeout includes connection time, any
@@ -33,3 +84,17 @@ func MakeClient(timeout time.Duration) *http.Client {
 		Timeout: timeout,
 	}
 }
+
+func durationOrDefault(value, fallback time.Duration) time.Duration {
+	if value == 0 {
+		return fallback
+	}
+	return value
+}
+
+func intOrDefault(value, fallback int) int {
+	if value == 0 {
+		return fallback
+	}
+	return value
+}
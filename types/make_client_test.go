@@ -0,0 +1,155 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_MakeClientWithTransport(t *testing.T) {
+	var TestCases = []struct {
+		Name     string
+		Config   TransportConfig
+		Expected *http.Transport
+	}{
+		{
+			Name:   "Zero values keep the defaults",
+			Config: TransportConfig{},
+			Expected: &http.Transport{
+				IdleConnTimeout:     120 * time.Millisecond,
+				MaxIdleConns:        100,
+				MaxIdleConnsPerHost: 100,
+			},
+		},
+		{
+			Name: "Tuned",
+			Config: TransportConfig{
+				TLSHandshakeTimeout:   time.Second,
+				ResponseHeaderTimeout: 5 * time.Second,
+				IdleConnTimeout:       90 * time.Second,
+				MaxIdleConns:          1000,
+				MaxIdleConnsPerHost:   500,
+				MaxConnsPerHost:       500,
+				EnableHTTP2:           true,
+			},
+			Expected: &http.Transport{
+				TLSHandshakeTimeout:   time.Second,
+				ResponseHeaderTimeout: 5 * time.Second,
+				IdleConnTimeout:       90 * time.Second,
+				MaxIdleConns:          1000,
+				MaxIdleConnsPerHost:   500,
+				MaxConnsPerHost:       500,
+				ForceAttemptHTTP2:     true,
+			},
+		},
+	}
+
+	for _, test := range TestCases {
+		t.Run(test.Name, func(t *testing.T) {
+			client := MakeClientWithTransport(time.Minute, test.Config)
+			got := client.Transport.(*http.Transport)
+
+			if client.Timeout != time.Minute {
+				t.Errorf("Timeout - want: %s, got: %s", time.Minute, client.Timeout)
+			}
+			if got.TLSHandshakeTimeout != test.Expected.TLSHandshakeTimeout {
+				t.Errorf("TLSHandshakeTimeout - want: %s, got: %s", test.Expected.TLSHandshakeTimeout, got.TLSHandshakeTimeout)
+			}
+			if got.ResponseHeaderTimeout != test.Expected.ResponseHeaderTimeout {
+				t.Errorf("ResponseHeaderTimeout - want: %s, got: %s", test.Expected.ResponseHeaderTimeout, got.ResponseHeaderTimeout)
+			}
+			if got.IdleConnTimeout != test.Expected.IdleConnTimeout {
+				t.Errorf("IdleConnTimeout - want: %s, got: %s", test.Expected.IdleConnTimeout, got.IdleConnTimeout)
+			}
+			if got.MaxIdleConns != test.Expected.MaxIdleConns {
+				t.Errorf("MaxIdleConns - want: %d, got: %d", test.Expected.MaxIdleConns, got.MaxIdleConns)
+			}
+			if got.MaxIdleConnsPerHost != test.Expected.MaxIdleConnsPerHost {
+				t.Errorf("MaxIdleConnsPerHost - want: %d, got: %d", test.Expected.MaxIdleConnsPerHost, got.MaxIdleConnsPerHost)
+			}
+			if got.MaxConnsPerHost != test.Expected.MaxConnsPerHost {
+				t.Errorf("MaxConnsPerHost - want: %d, got: %d", test.Expected.MaxConnsPerHost, got.MaxConnsPerHost)
+			}
+			if got.ForceAttemptHTTP2 != test.Expected.ForceAttemptHTTP2 {
+				t.Errorf("ForceAttemptHTTP2 - want: %t, got: %t", test.Expected.ForceAttemptHTTP2, got.ForceAttemptHTTP2)
+			}
+		})
+	}
+}
+
+func Test_MakeClientWithTransport_HTTP2(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	for _, enabled := range []bool{false, true} {
+		client := baseClient(&ControllerConfig{
+			UpstreamTimeout: time.Second,
+			Transport:       TransportConfig{EnableHTTP2: enabled},
+			TLS:             &TLSConfig{InsecureSkipVerify: true},
+		})
+
+		res, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		want := 1
+		if enabled {
+			want = 2
+		}
+		if res.ProtoMajor != want {
+			t.Errorf("Protocol with EnableHTTP2: %t - want: HTTP/%d, got: %s", enabled, want, res.Proto)
+		}
+	}
+}
+
+type countingRoundTripper struct {
+	requests int32
+}
+
+func (c *countingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&c.requests, 1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func Test_Controller_CustomRoundTripper(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	transport := &countingRoundTripper{}
+	c := NewController(nil, &ControllerConfig{
+		GatewayURL:      srv.URL,
+		UpstreamTimeout: time.Second,
+		RoundTripper:    transport,
+		Authenticator:   NewBearerAuthenticator(StaticTokenSource("token1")),
+	}).(*controller)
+
+	lookup := map[string][]string{"topic1": {"echo"}}
+	c.TopicMap.Sync(&lookup)
+
+	body := []byte("hello")
+	if _, err := c.InvokeAndWait(context.Background(), "topic1", &body, http.Header{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := atomic.LoadInt32(&transport.requests); got != 1 {
+		t.Errorf("Requests - want: %d, got: %d", 1, got)
+	}
+}
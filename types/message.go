@@ -0,0 +1,212 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Message is a message received from a broker or other source, to be
+// published to the functions which subscribe to its topic.
+type Message struct {
+	// Topic the message was received on
+	Topic string
+
+	// Body is sent to each function as the request body
+	Body []byte
+
+	// BodyReader is streamed to each function instead of Body. It can only
+	// be read once, so when several functions match it is copied to all of
+	// them as it is read, and failed invocations are not retried. Optional.
+	BodyReader io.Reader
+
+	// GetBody opens the body again for each function and each retry,
+	// instead of Body or BodyReader. Optional.
+	GetBody func() (io.ReadCloser, error)
+
+	// Header is added to the request sent to each function
+	Header http.Header
+
+	// ID identifies the message at its source. Optional.
+	ID string
+
+	// PartitionKey is the key the source used to partition or order the message. Optional.
+	PartitionKey string
+
+	// Timestamp is when the message was produced at its source. Optional.
+	Timestamp time.Time
+
+	// Ack is called by Publish once every matched function has been invoked successfully. Optional.
+	Ack func() error
+
+	// Nack is called by Publish with the error when any matched function could not be invoked successfully. Optional.
+	Nack func(error) error
+
+	// StreamResponse is passed the response body of each function as it is
+	// read, instead of it being read into InvokerResponse.Body. It is only
+	// called for the final attempt and must not retain body. Optional.
+	StreamResponse func(res InvokerResponse, body io.Reader) error
+}
+
+// newMessage adapts the arguments of the Invoke methods to a Message
+func newMessage(topic string, message *[]byte, headers http.Header) *Message {
+	msg := &Message{
+		Topic:  topic,
+		Header: headers,
+	}
+
+	if message != nil {
+		msg.Body = *message
+	}
+
+	return msg
+}
+
+// settle calls Ack when err is nil or Nack otherwise, and returns the
+// error along with any error from the callback.
+func (m *Message) settle(err error) error {
+	if err == nil {
+		if m.Ack != nil {
+			return m.Ack()
+		}
+		return nil
+	}
+
+	if m.Nack != nil {
+		if nackErr := m.Nack(err); nackErr != nil {
+			return fmt.Errorf("%w, unable to nack message: %s", err, nackErr)
+		}
+	}
+
+	return err
+}
+
+// hasBody reports whether there is anything to send
+func (m *Message) hasBody() bool {
+	return len(m.Body) > 0 || m.BodyReader != nil || m.GetBody != nil
+}
+
+// errBodyConsumed is returned when a one-shot body is opened a second time
+var errBodyConsumed = errors.New("message body has already been read")
+
+// requestBody opens the body of a message for each request made to a
+// single function.
+type requestBody struct {
+	open func() (io.ReadCloser, error)
+
+	// replayable bodies can be opened again to retry a request
+	replayable bool
+
+	// release is called once the function has been invoked, if not nil
+	release func()
+}
+
+// requestBodies returns a body for each of n matched functions. shared is
+// true when the functions read from the same stream, and must therefore
+// be invoked concurrently.
+func (m *Message) requestBodies(n int) (bodies []*requestBody, shared bool) {
+	bodies = make([]*requestBody, n)
+
+	switch {
+	case m.GetBody != nil:
+		for i := range bodies {
+			bodies[i] = &requestBody{open: m.GetBody, replayable: true}
+		}
+
+	case m.BodyReader != nil && n > 1:
+		for i, reader := range teeReader(m.BodyReader, n) {
+			reader := reader
+			bodies[i] = &requestBody{
+				open:    openOnce(reader),
+				release: func() { reader.Close() },
+			}
+		}
+		shared = true
+
+	case m.BodyReader != nil:
+		for i := range bodies {
+			bodies[i] = &requestBody{open: openOnce(io.NopCloser(m.BodyReader))}
+		}
+
+	default:
+		for i := range bodies {
+			bodies[i] = &requestBody{
+				open: func() (io.ReadCloser, error) {
+					return io.NopCloser(bytes.NewReader(m.Body)), nil
+				},
+				replayable: true,
+			}
+		}
+	}
+
+	return bodies, shared
+}
+
+func (b *requestBody) close() {
+	if b.release != nil {
+		b.release()
+	}
+}
+
+// openOnce returns reader on the first call and errBodyConsumed afterwards
+func openOnce(reader io.ReadCloser) func() (io.ReadCloser, error) {
+	opened := false
+	return func() (io.ReadCloser, error) {
+		if opened {
+			return nil, errBodyConsumed
+		}
+		opened = true
+		return reader, nil
+	}
+}
+
+// teeReader copies src to n readers as they read it, without buffering
+// more than a single write. A reader which is closed early stops receiving
+// data without affecting the others.
+func teeReader(src io.Reader, n int) []*io.PipeReader {
+	readers := make([]*io.PipeReader, n)
+	writers := make([]*io.PipeWriter, n)
+	for i := range readers {
+		readers[i], writers[i] = io.Pipe()
+	}
+
+	go func() {
+		_, err := io.Copy(&multiPipeWriter{writers: writers, failed: make([]bool, n)}, src)
+		for _, w := range writers {
+			w.CloseWithError(err)
+		}
+	}()
+
+	return readers
+}
+
+// multiPipeWriter writes to every pipe which has not failed yet
+type multiPipeWriter struct {
+	writers []*io.PipeWriter
+	failed  []bool
+}
+
+func (m *multiPipeWriter) Write(p []byte) (int, error) {
+	written := false
+	for i, w := range m.writers {
+		if m.failed[i] {
+			continue
+		}
+		if _, err := w.Write(p); err != nil {
+			m.failed[i] = true
+			continue
+		}
+		written = true
+	}
+
+	if !written {
+		return 0, io.ErrClosedPipe
+	}
+	return len(p), nil
+}
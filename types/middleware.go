@@ -0,0 +1,86 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"net/http"
+)
+
+// Invocation is a single request from the Invoker to a function, as seen
+// by each Middleware.
+type Invocation struct {
+	Topic    string
+	Function string
+
+	// Attempt is 1 for the first request, and counts up on each retry
+	Attempt int
+
+	// Message is the message being published to the function
+	Message *Message
+
+	// Request to the gateway, which may be modified or replaced before
+	// calling the next RoundTripFunc. Its body may be streamed, so a
+	// middleware which reads it must replace it.
+	Request *http.Request
+}
+
+// RoundTripFunc sends an invocation to the function and returns its
+// response, or an error if the function could not be reached.
+type RoundTripFunc func(invocation *Invocation) (*http.Response, error)
+
+// Middleware wraps the RoundTripFunc which sends each request to a
+// function, i.e. to add headers, sign requests or log responses. It must
+// call next to send the request, unless it returns a response or an error
+// itself.
+type Middleware func(next RoundTripFunc) RoundTripFunc
+
+// UserAgentMiddleware sets the User-Agent header to userAgent, unless the
+// request already has one or userAgent is empty.
+func UserAgentMiddleware(userAgent string) Middleware {
+	return headerMiddleware("User-Agent", func(*Invocation) string {
+		return userAgent
+	})
+}
+
+// TopicHeaderMiddleware sets the X-Topic header to the topic of the
+// message, unless the request already has one.
+func TopicHeaderMiddleware() Middleware {
+	return headerMiddleware("X-Topic", func(invocation *Invocation) string {
+		return invocation.Topic
+	})
+}
+
+// ConnectorHeaderMiddleware sets the X-Connector header to name, unless the
+// request already has one.
+func ConnectorHeaderMiddleware(name string) Middleware {
+	return headerMiddleware("X-Connector", func(*Invocation) string {
+		return name
+	})
+}
+
+// headerMiddleware sets the header key to the value returned for the
+// invocation, when the request does not have the header and the value is
+// not empty
+func headerMiddleware(key string, value func(*Invocation) string) Middleware {
+	return func(next RoundTripFunc) RoundTripFunc {
+		return func(invocation *Invocation) (*http.Response, error) {
+			if len(invocation.Request.Header.Get(key)) == 0 {
+				if v := value(invocation); len(v) > 0 {
+					invocation.Request.Header.Set(key, v)
+				}
+			}
+
+			return next(invocation)
+		}
+	}
+}
+
+// chain wraps send with middleware, so that the first middleware is the
+// outermost
+func chain(send RoundTripFunc, middleware ...Middleware) RoundTripFunc {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		send = middleware[i](send)
+	}
+	return send
+}
@@ -0,0 +1,154 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_Invoker_BuiltInHeaders(t *testing.T) {
+	var TestCases = []struct {
+		Name     string
+		Headers  http.Header
+		Expected http.Header
+	}{
+		{
+			Name:    "Defaults",
+			Headers: http.Header{},
+			Expected: http.Header{
+				"User-Agent":  {"openfaasltd/timer-connector"},
+				"X-Topic":     {"topic1"},
+				"X-Connector": {"connector-sdk"},
+			},
+		},
+		{
+			Name:    "Message headers are kept",
+			Headers: http.Header{"X-Connector": {"cmd/timer"}, "User-Agent": {"custom"}},
+			Expected: http.Header{
+				"User-Agent":  {"custom"},
+				"X-Topic":     {"topic1"},
+				"X-Connector": {"cmd/timer"},
+			},
+		},
+	}
+
+	for _, test := range TestCases {
+		t.Run(test.Name, func(t *testing.T) {
+			received := make(chan http.Header, 1)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received <- r.Header
+			}))
+			defer srv.Close()
+
+			invoker := NewInvoker(srv.URL, srv.Client(), "", false, false, "openfaasltd/timer-connector")
+			collect := collectResponses(invoker)
+
+			topicMap := NewTopicMap()
+			lookup := map[string][]string{"topic1": {"echo"}}
+			topicMap.Sync(&lookup)
+
+			body := []byte("hello")
+			invoker.InvokeAndWait(context.Background(), &topicMap, "topic1", &body, test.Headers)
+			collect()
+
+			header := <-received
+			for key, want := range test.Expected {
+				if got := header.Values(key); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s - want: %v, got: %v", key, want, got)
+				}
+			}
+		})
+	}
+}
+
+func Test_Controller_Middleware(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Signature") != "signed:echo" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	var lock sync.Mutex
+	var calls []string
+	record := func(name string) Middleware {
+		return func(next RoundTripFunc) RoundTripFunc {
+			return func(invocation *Invocation) (*http.Response, error) {
+				res, err := next(invocation)
+
+				lock.Lock()
+				defer lock.Unlock()
+				calls = append(calls, name+" "+invocation.Topic+" "+invocation.Function+" "+
+					invocation.Request.Header.Get("X-Topic")+" "+res.Status)
+				return res, err
+			}
+		}
+	}
+
+	sign := func(next RoundTripFunc) RoundTripFunc {
+		return func(invocation *Invocation) (*http.Response, error) {
+			invocation.Request.Header.Set("X-Signature", "signed:"+invocation.Function)
+			return next(invocation)
+		}
+	}
+
+	c := NewController(nil, &ControllerConfig{
+		GatewayURL:      srv.URL,
+		UpstreamTimeout: time.Second,
+		Middleware:      []Middleware{record("outer")},
+	})
+	c.Use(sign, record("inner"))
+
+	lookup := map[string][]string{"topic1": {"echo"}}
+	c.(*controller).TopicMap.Sync(&lookup)
+
+	body := []byte("hello")
+	responses, err := c.InvokeAndWait(context.Background(), "topic1", &body, http.Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if responses[0].Status != http.StatusAccepted {
+		t.Errorf("Status - want: %d, got: %d", http.StatusAccepted, responses[0].Status)
+	}
+
+	want := []string{
+		"inner topic1 echo topic1 202 Accepted",
+		"outer topic1 echo topic1 202 Accepted",
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("Calls - want: %v, got: %v", want, calls)
+	}
+}
+
+func Test_Invoker_MiddlewareError(t *testing.T) {
+	invoker := NewInvoker("http://127.0.0.1:0/function", MakeClient(time.Second), "", false, false, "")
+	invoker.Use(func(next RoundTripFunc) RoundTripFunc {
+		return func(invocation *Invocation) (*http.Response, error) {
+			return nil, errors.New("request not signed")
+		}
+	})
+	collect := collectResponses(invoker)
+
+	topicMap := NewTopicMap()
+	lookup := map[string][]string{"topic1": {"echo"}}
+	topicMap.Sync(&lookup)
+
+	body := []byte("hello")
+	responses := invoker.InvokeAndWait(context.Background(), &topicMap, "topic1", &body, http.Header{})
+	collect()
+
+	if responses[0].Outcome != OutcomeFailed || responses[0].Error == nil {
+		t.Errorf("Response - want: %s with error, got: %s with %v", OutcomeFailed, responses[0].Outcome, responses[0].Error)
+	}
+}
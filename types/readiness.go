@@ -0,0 +1,190 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ReadinessPolicy decides what happens to messages which are published
+// before the controller is ready, which is once the topic map has been
+// synced for the first time or restored from a snapshot.
+type ReadinessPolicy string
+
+const (
+	// ReadinessNone invokes messages straight away, so they only match
+	// functions once the topic map has been synced. This is the default.
+	ReadinessNone ReadinessPolicy = ""
+
+	// ReadinessBlock waits for the controller to be ready, for up to
+	// ControllerConfig.ReadinessTimeout, or until it is shut down.
+	ReadinessBlock ReadinessPolicy = "block"
+
+	// ReadinessBuffer queues up to ControllerConfig.ReadinessBufferSize
+	// messages, which are invoked in order once the controller is ready.
+	ReadinessBuffer ReadinessPolicy = "buffer"
+
+	// ReadinessReject fails messages with a *NotReadyError
+	ReadinessReject ReadinessPolicy = "reject"
+)
+
+// errReadinessBufferFull is wrapped by a NotReadyError when a message
+// cannot be buffered.
+var errReadinessBufferFull = errors.New("readiness buffer is full")
+
+// NotReadyError is returned for a message which was published before the
+// controller was ready, and could not be held until it was.
+type NotReadyError struct {
+	Topic  string
+	Policy ReadinessPolicy
+
+	// Err is why the message could not be held, if it was not rejected
+	// outright, i.e. context.DeadlineExceeded when blocking timed out.
+	Err error
+}
+
+func (e *NotReadyError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("controller is not ready to invoke topic %s, error: %s", e.Topic, e.Err)
+	}
+	return fmt.Sprintf("controller is not ready to invoke topic %s", e.Topic)
+}
+
+func (e *NotReadyError) Unwrap() error {
+	return e.Err
+}
+
+// pendingMessage is a message buffered until the controller is ready
+type pendingMessage struct {
+	ctx context.Context
+	msg *Message
+
+	// done receives the result of the invocation, if not nil
+	done chan pendingResult
+}
+
+type pendingResult struct {
+	responses []InvokerResponse
+	err       error
+}
+
+// Ready is closed once the topic map has been synced for the first time,
+// or restored from a snapshot.
+func (c *controller) Ready() <-chan struct{} {
+	return c.ready
+}
+
+// markReady closes the ready channel, once.
+func (c *controller) markReady() {
+	c.readyLock.Lock()
+	defer c.readyLock.Unlock()
+
+	if !c.isReady {
+		c.isReady = true
+		close(c.ready)
+	}
+}
+
+// awaitReady applies the readiness policy to a message registered with
+// begin. When queued is true, the message has been buffered and the
+// buffer is responsible for ending the invocation and sending the result
+// to done, if it is not nil.
+func (c *controller) awaitReady(ctx context.Context, msg *Message, done chan pendingResult) (queued bool, err error) {
+	select {
+	case <-c.ready:
+		return false, nil
+	default:
+	}
+
+	switch c.Config.ReadinessPolicy {
+	case ReadinessBlock:
+		var timeout <-chan time.Time
+		if c.Config.ReadinessTimeout > 0 {
+			timer := time.NewTimer(c.Config.ReadinessTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case <-c.ready:
+			return false, nil
+		case <-timeout:
+			return false, &NotReadyError{Topic: msg.Topic, Policy: ReadinessBlock, Err: context.DeadlineExceeded}
+		case <-ctx.Done():
+			return false, &NotReadyError{Topic: msg.Topic, Policy: ReadinessBlock, Err: ctx.Err()}
+		case <-c.stop:
+			return false, ErrControllerShutdown
+		}
+
+	case ReadinessBuffer:
+		c.readyLock.Lock()
+		defer c.readyLock.Unlock()
+
+		if c.isReady {
+			return false, nil
+		}
+		if c.pendingClosed {
+			return false, ErrControllerShutdown
+		}
+
+		select {
+		case c.pending <- &pendingMessage{ctx: ctx, msg: msg, done: done}:
+			return true, nil
+		default:
+			return false, &NotReadyError{Topic: msg.Topic, Policy: ReadinessBuffer, Err: errReadinessBufferFull}
+		}
+
+	case ReadinessReject:
+		return false, &NotReadyError{Topic: msg.Topic, Policy: ReadinessReject}
+	}
+
+	return false, nil
+}
+
+// invokePending invokes buffered messages in order once the controller is
+// ready, or fails them with ErrControllerShutdown if it is shut down first.
+func (c *controller) invokePending() {
+	select {
+	case <-c.ready:
+	case <-c.stop:
+	}
+
+	// nothing more can be buffered once ready is closed or pending is
+	// closed, so the buffer is empty once drained
+	c.readyLock.Lock()
+	c.pendingClosed = true
+	c.readyLock.Unlock()
+
+	for {
+		select {
+		case p := <-c.pending:
+			c.invokePendingMessage(p)
+		default:
+			return
+		}
+	}
+}
+
+func (c *controller) invokePendingMessage(p *pendingMessage) {
+	defer c.inFlight.Done()
+
+	var result pendingResult
+
+	select {
+	case <-c.ready:
+		result.responses = c.Invoker.Publish(p.ctx, c.TopicMap, p.msg)
+		result.err = p.msg.settle(responsesError(p.msg.Topic, result.responses))
+	default:
+		log.Printf("[connector] unable to invoke buffered message for topic %s, error: %s", p.msg.Topic, ErrControllerShutdown)
+		result.err = p.msg.settle(ErrControllerShutdown)
+	}
+
+	if p.done != nil {
+		p.done <- result
+	}
+}
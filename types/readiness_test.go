@@ -0,0 +1,206 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newReadinessController(t *testing.T, config *ControllerConfig) (*controller, func()) {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(srv.Close)
+
+	path := filepath.Join(t.TempDir(), "topics.yaml")
+	if err := os.WriteFile(path, []byte("topic1:\n- echo\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config.GatewayURL = srv.URL
+	config.UpstreamTimeout = time.Second
+
+	c := NewController(nil, config).(*controller)
+	syncTopics := func() {
+		c.syncLookups(NewFileFunctionSource(path), c.TopicMap)
+	}
+
+	return c, syncTopics
+}
+
+func Test_Readiness_NotReadyError(t *testing.T) {
+	var TestCases = []struct {
+		Name        string
+		Config      ControllerConfig
+		ExpectedErr error
+	}{
+		{
+			Name:   "Reject",
+			Config: ControllerConfig{ReadinessPolicy: ReadinessReject},
+		},
+		{
+			Name:        "Block times out",
+			Config:      ControllerConfig{ReadinessPolicy: ReadinessBlock, ReadinessTimeout: 10 * time.Millisecond},
+			ExpectedErr: context.DeadlineExceeded,
+		},
+		{
+			Name:        "Buffer is full",
+			Config:      ControllerConfig{ReadinessPolicy: ReadinessBuffer},
+			ExpectedErr: errReadinessBufferFull,
+		},
+	}
+
+	for _, test := range TestCases {
+		t.Run(test.Name, func(t *testing.T) {
+			c, _ := newReadinessController(t, &test.Config)
+
+			var nacked error
+			err := c.Publish(context.Background(), Message{
+				Topic: "topic1",
+				Body:  []byte("hello"),
+				Nack: func(err error) error {
+					nacked = err
+					return nil
+				},
+			})
+
+			var notReady *NotReadyError
+			if !errors.As(err, &notReady) {
+				t.Fatalf("Error - want: *NotReadyError, got: %v", err)
+			}
+			if notReady.Policy != test.Config.ReadinessPolicy {
+				t.Errorf("Policy - want: %q, got: %q", test.Config.ReadinessPolicy, notReady.Policy)
+			}
+			if notReady.Err != test.ExpectedErr {
+				t.Errorf("Cause - want: %v, got: %v", test.ExpectedErr, notReady.Err)
+			}
+			if nacked != err {
+				t.Errorf("Nack - want: %v, got: %v", err, nacked)
+			}
+		})
+	}
+}
+
+func Test_Readiness_BlockWaitsForSync(t *testing.T) {
+	c, syncTopics := newReadinessController(t, &ControllerConfig{ReadinessPolicy: ReadinessBlock})
+
+	body := []byte("hello")
+	result := make(chan []InvokerResponse)
+	go func() {
+		responses, _ := c.InvokeAndWait(context.Background(), "topic1", &body, http.Header{})
+		result <- responses
+	}()
+
+	select {
+	case <-result:
+		t.Fatalf("InvokeAndWait returned before the controller was ready")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	syncTopics()
+
+	select {
+	case <-c.Ready():
+	default:
+		t.Errorf("Ready - want: closed after sync, got: open")
+	}
+
+	if responses := <-result; len(responses) != 1 {
+		t.Errorf("Responses - want: %d, got: %d", 1, len(responses))
+	}
+}
+
+func Test_Readiness_BufferInvokesOnceReady(t *testing.T) {
+	c, syncTopics := newReadinessController(t, &ControllerConfig{ReadinessPolicy: ReadinessBuffer, ReadinessBufferSize: 2})
+
+	acked := make(chan string, 2)
+	for _, id := range []string{"1", "2"} {
+		id := id
+		err := c.Publish(context.Background(), Message{
+			Topic: "topic1",
+			ID:    id,
+			Body:  []byte("hello"),
+			Ack: func() error {
+				acked <- id
+				return nil
+			},
+		})
+		if err != nil {
+			t.Fatalf("Publish %s - want: buffered, got: %s", id, err)
+		}
+	}
+
+	syncTopics()
+
+	for _, want := range []string{"1", "2"} {
+		select {
+		case got := <-acked:
+			if got != want {
+				t.Errorf("Ack order - want: %s, got: %s", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Buffered message %s was not acknowledged", want)
+		}
+	}
+}
+
+func Test_Readiness_ShutdownNacksBuffered(t *testing.T) {
+	c, _ := newReadinessController(t, &ControllerConfig{ReadinessPolicy: ReadinessBuffer, ReadinessBufferSize: 1})
+
+	nacked := make(chan error, 1)
+	err := c.Publish(context.Background(), Message{
+		Topic: "topic1",
+		Body:  []byte("hello"),
+		Nack: func(err error) error {
+			nacked <- err
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Publish - want: buffered, got: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown - want: no error, got: %s", err)
+	}
+
+	if err := <-nacked; err != ErrControllerShutdown {
+		t.Errorf("Nack - want: %s, got: %v", ErrControllerShutdown, err)
+	}
+}
+
+func Test_Readiness_ShutdownReleasesBlocked(t *testing.T) {
+	c, _ := newReadinessController(t, &ControllerConfig{ReadinessPolicy: ReadinessBlock})
+
+	body := []byte("hello")
+	result := make(chan error, 1)
+	go func() {
+		_, err := c.InvokeAndWait(context.Background(), "topic1", &body, http.Header{})
+		result <- err
+	}()
+
+	// Let the invocation block on readiness
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown - want: no error, got: %s", err)
+	}
+
+	if err := <-result; err != ErrControllerShutdown {
+		t.Errorf("InvokeAndWait - want: %s, got: %v", ErrControllerShutdown, err)
+	}
+}
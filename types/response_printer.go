@@ -18,6 +18,8 @@ type ResponsePrinter struct {
 func (rp *ResponsePrinter) Response(res InvokerResponse) {
 	if res.Error != nil {
 		log.Printf("[connector] got error: %s", res.Error.Error())
+	} else if res.Body == nil {
+		log.Printf("[connector] got result: [%d] %s => %s (streamed)", res.Status, res.Topic, res.Function)
 	} else {
 		log.Printf("[connector] got result: [%d] %s => %s (%d) bytes", res.Status, res.Topic, res.Function, len(*res.Body))
 		if rp.PrintResponseBody {
@@ -0,0 +1,140 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultRetryableStatusCodes are retried when RetryPolicy.RetryableStatusCodes is not set
+var DefaultRetryableStatusCodes = []int{
+	http.StatusTooManyRequests,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// RetryPolicy controls how a function invocation is retried when the request
+// fails at the network level or the gateway returns a retryable status code.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts including the first one,
+	// zero or one disables retries.
+	MaxAttempts int
+
+	// BaseBackoff is the delay before the first retry, it is doubled for
+	// each subsequent retry.
+	BaseBackoff time.Duration
+
+	// MaxBackoff caps the delay between attempts, including any delay
+	// requested by the gateway via a Retry-After header. Optional.
+	MaxBackoff time.Duration
+
+	// Jitter is the fraction of each delay, between 0 and 1, which is
+	// randomized to spread out retries from many connectors.
+	Jitter float64
+
+	// RetryableStatusCodes are the status codes which are retried.
+	// Optional, if not set DefaultRetryableStatusCodes is used.
+	RetryableStatusCodes []int
+}
+
+// shouldRetry reports whether an attempt which failed with status or err
+// should be retried after attempt attempts have been made.
+func (p *RetryPolicy) shouldRetry(attempt, status int, err error) bool {
+	return p != nil && attempt < p.MaxAttempts && p.retryable(status, err)
+}
+
+// retryable reports whether a failure is of a kind the policy retries,
+// network errors are always retryable.
+func (p *RetryPolicy) retryable(status int, err error) bool {
+	if p == nil {
+		return false
+	}
+
+	if err != nil {
+		return true
+	}
+
+	codes := p.RetryableStatusCodes
+	if len(codes) == 0 {
+		codes = DefaultRetryableStatusCodes
+	}
+
+	for _, code := range codes {
+		if code == status {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the delay before the attempt following attempt. A
+// Retry-After header takes precedence over the exponential backoff.
+func (p *RetryPolicy) backoff(attempt int, header *http.Header) time.Duration {
+	var delay time.Duration
+
+	if retryAfter, ok := parseRetryAfter(header); ok {
+		delay = retryAfter
+	} else {
+		delay = p.BaseBackoff
+		for i := 1; i < attempt && (p.MaxBackoff <= 0 || delay < p.MaxBackoff); i++ {
+			delay *= 2
+		}
+
+		if p.Jitter > 0 {
+			jitter := time.Duration(float64(delay) * p.Jitter * rand.Float64())
+			delay = delay - time.Duration(float64(delay)*p.Jitter/2) + jitter
+		}
+	}
+
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+
+	return delay
+}
+
+// parseRetryAfter reads a Retry-After header given either in seconds or
+// as an HTTP date.
+func parseRetryAfter(header *http.Header) (time.Duration, bool) {
+	if header == nil {
+		return 0, false
+	}
+
+	value := header.Get("Retry-After")
+	if len(value) == 0 {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if at, err := http.ParseTime(value); err == nil {
+		delay := time.Until(at)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+
+	return 0, false
+}
+
+// sleepContext waits for delay or until ctx is done.
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
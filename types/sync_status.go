@@ -0,0 +1,81 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"time"
+)
+
+// DefaultSyncBackoff is the delay before retrying a failed sync of the
+// topic map when ControllerConfig.SyncBackoff is not set.
+const DefaultSyncBackoff = time.Second
+
+// SyncStatus reports the health of the topic map sync. The last known good
+// topic map is kept when a sync fails.
+type SyncStatus struct {
+	// LastAttempt is when the topic map was last synced, successfully or not
+	LastAttempt time.Time
+
+	// LastSuccess is when the topic map was last synced successfully, it is
+	// zero until the first successful sync.
+	LastSuccess time.Time
+
+	// ConsecutiveFailures is the number of syncs which have failed since
+	// the last successful one.
+	ConsecutiveFailures int
+
+	// LastError is the error from the most recent sync, nil if it succeeded.
+	// A successful sync may still report a *BuildError which lists
+	// malformed topic annotations.
+	LastError error
+
+	// Generation of the topic map, which is incremented by each sync and
+	// restored from a snapshot.
+	Generation uint64
+
+	// Stale is true when the topic map was restored from a snapshot and no
+	// sync has succeeded since.
+	Stale bool
+}
+
+// SyncFailure describes a failed sync of the topic map.
+type SyncFailure struct {
+	// Error returned when building the topic map
+	Error error
+
+	// ConsecutiveFailures is the number of syncs which have failed since
+	// the last successful one, including this one.
+	ConsecutiveFailures int
+
+	// LastSuccess is when the topic map was last synced successfully, it is
+	// zero if no sync has succeeded yet.
+	LastSuccess time.Time
+
+	// RetryAt is when the sync will next be attempted
+	RetryAt time.Time
+}
+
+// SyncSubscriber can be implemented by a ResponseSubscriber to be notified
+// when a sync of the topic map fails, for instance to exit after too many
+// consecutive failures. It is called from the sync goroutine, so it must
+// not block.
+type SyncSubscriber interface {
+	SyncFailed(SyncFailure)
+}
+
+// syncBackoff returns the delay before retrying after failures consecutive
+// failed syncs, doubling from base up to the rebuild interval.
+func syncBackoff(base, rebuildInterval time.Duration, failures int) time.Duration {
+	if base <= 0 {
+		base = DefaultSyncBackoff
+	}
+
+	policy := RetryPolicy{
+		BaseBackoff: base,
+		MaxBackoff:  rebuildInterval,
+		Jitter:      0.2,
+	}
+
+	return policy.backoff(failures, nil)
+}
@@ -0,0 +1,183 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// TLSConfig configures TLS for the connections to the gateway, both to list
+// and to invoke functions. The CA bundle and client certificate are read
+// when a connection is made, and read again whenever their files change,
+// so rotated certificates are used for new connections without a restart.
+// If a file cannot be read, the last certificates which could be read are
+// kept, and until there are any, requests fail with the error.
+type TLSConfig struct {
+	// CAFile is a PEM bundle of the certificate authorities trusted to
+	// verify the gateway's certificate, in place of the system's.
+	CAFile string
+
+	// CertFile and KeyFile are the PEM client certificate and key
+	// presented for mutual TLS.
+	CertFile string
+	KeyFile  string
+
+	// ServerName verifies the gateway's certificate for a name other than
+	// the host of the GatewayURL. It is required with a CAFile when the
+	// gateway is addressed by IP.
+	ServerName string
+
+	// MinVersion is the minimum TLS version, tls.VersionTLS12 if zero.
+	MinVersion uint16
+
+	// InsecureSkipVerify does not verify the gateway's certificate, and
+	// should only be used for development.
+	InsecureSkipVerify bool
+
+	once   sync.Once
+	config *tls.Config
+
+	lock         sync.Mutex
+	roots        *x509.CertPool
+	rootsVersion fileVersion
+	cert         *tls.Certificate
+	certVersion  [2]fileVersion
+}
+
+// ClientConfig returns a tls.Config for the options. Each call returns a
+// copy, since a transport may modify its config, i.e. to enable HTTP/2,
+// but the copies share the loaded certificates.
+func (t *TLSConfig) ClientConfig() *tls.Config {
+	t.once.Do(func() {
+		config := &tls.Config{
+			ServerName:         t.ServerName,
+			MinVersion:         t.MinVersion,
+			InsecureSkipVerify: t.InsecureSkipVerify,
+		}
+
+		if config.MinVersion == 0 {
+			config.MinVersion = tls.VersionTLS12
+		}
+
+		if len(t.CertFile) > 0 || len(t.KeyFile) > 0 {
+			config.GetClientCertificate = t.clientCertificate
+		}
+
+		if t.InsecureSkipVerify {
+			log.Printf("[connector] TLS certificate verification is disabled")
+		} else if len(t.CAFile) > 0 {
+			// The roots may change between connections, so verification is
+			// done by verifyConnection in place of the built-in check
+			config.InsecureSkipVerify = true
+			config.VerifyConnection = t.verifyConnection
+		}
+
+		t.config = config
+	})
+
+	return t.config.Clone()
+}
+
+// verifyConnection verifies the gateway's certificate chain and name
+// against the current CA bundle.
+func (t *TLSConfig) verifyConnection(state tls.ConnectionState) error {
+	roots, err := t.rootCAs()
+	if err != nil {
+		return err
+	}
+
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("no certificate presented by the gateway")
+	}
+
+	// An IP address is not sent as the server name, so it cannot be
+	// verified against the certificate here
+	if len(state.ServerName) == 0 {
+		return errors.New("unable to verify the gateway's certificate without a server name, set ServerName when the gateway is addressed by IP")
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       state.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	_, err = state.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// rootCAs returns the CA bundle, reading it again if the file changed
+func (t *TLSConfig) rootCAs() (*x509.CertPool, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	version := statFile(t.CAFile)
+	if t.roots != nil && version == t.rootsVersion {
+		return t.roots, nil
+	}
+
+	roots, err := readCAFile(t.CAFile)
+	if err != nil {
+		if t.roots == nil {
+			return nil, err
+		}
+
+		log.Printf("[connector] %s, keeping the last CA bundle", err)
+		t.rootsVersion = version
+		return t.roots, nil
+	}
+
+	t.roots, t.rootsVersion = roots, version
+	return t.roots, nil
+}
+
+// clientCertificate returns the client certificate, reading it again if
+// either file changed
+func (t *TLSConfig) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	version := [2]fileVersion{statFile(t.CertFile), statFile(t.KeyFile)}
+	if t.cert != nil && version == t.certVersion {
+		return t.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		err = fmt.Errorf("unable to load client certificate %s, error: %w", t.CertFile, err)
+		if t.cert == nil {
+			return nil, err
+		}
+
+		log.Printf("[connector] %s, keeping the last client certificate", err)
+		t.certVersion = version
+		return t.cert, nil
+	}
+
+	t.cert, t.certVersion = &cert, version
+	return t.cert, nil
+}
+
+func readCAFile(path string) (*x509.CertPool, error) {
+	bundle, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read CA bundle %s, error: %w", path, err)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", path)
+	}
+
+	return roots, nil
+}
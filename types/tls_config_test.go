@@ -0,0 +1,277 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testCertificate struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCertificate issues a certificate for name, signed by parent, or
+// self-signed as a CA when parent is nil
+func newTestCertificate(t *testing.T, name string, parent *testCertificate) *testCertificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	return &testCertificate{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make sure a rewrite is seen as a change on file systems with a
+	// coarse modification time
+	modTime := time.Now().Add(time.Duration(len(data)) * time.Millisecond)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_TLSConfig_MutualTLSWithReload(t *testing.T) {
+	ca := newTestCertificate(t, "ca", nil)
+	server := newTestCertificate(t, "localhost", ca)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	clients := make(chan string, 10)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clients <- r.TLS.PeerCertificates[0].Subject.CommonName
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.cert.Raw}, PrivateKey: server.key}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir := t.TempDir()
+	config := &TLSConfig{
+		CAFile:     filepath.Join(dir, "ca.crt"),
+		CertFile:   filepath.Join(dir, "tls.crt"),
+		KeyFile:    filepath.Join(dir, "tls.key"),
+		ServerName: "localhost",
+	}
+
+	client := baseClient(&ControllerConfig{UpstreamTimeout: time.Second, TLS: config})
+
+	// Requests fail until the files exist
+	if _, err := client.Get(srv.URL); err == nil {
+		t.Fatalf("Error without CA bundle - want: error, got: nil")
+	}
+
+	first := newTestCertificate(t, "connector1", ca)
+	writeFile(t, config.CAFile, ca.certPEM)
+	writeFile(t, config.CertFile, first.certPEM)
+	writeFile(t, config.KeyFile, first.keyPEM)
+
+	for _, want := range []string{"connector1", "connector2"} {
+		res, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("Request as %s - want: no error, got: %s", want, err)
+		}
+		res.Body.Close()
+
+		if got := <-clients; got != want {
+			t.Errorf("Client certificate - want: %s, got: %s", want, got)
+		}
+
+		rotated := newTestCertificate(t, "connector2", ca)
+		writeFile(t, config.CertFile, rotated.certPEM)
+		writeFile(t, config.KeyFile, rotated.keyPEM)
+		client.CloseIdleConnections()
+	}
+}
+
+func Test_TLSConfig_VerifiesGateway(t *testing.T) {
+	ca := newTestCertificate(t, "ca", nil)
+	other := newTestCertificate(t, "other-ca", nil)
+	server := newTestCertificate(t, "localhost", ca)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.cert.Raw}, PrivateKey: server.key}},
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "ca.crt"), ca.certPEM)
+	writeFile(t, filepath.Join(dir, "other-ca.crt"), other.certPEM)
+
+	var TestCases = []struct {
+		Name        string
+		Config      *TLSConfig
+		ExpectedErr bool
+	}{
+		{
+			Name:   "Trusted CA",
+			Config: &TLSConfig{CAFile: filepath.Join(dir, "ca.crt"), ServerName: "localhost"},
+		},
+		{
+			Name:        "Untrusted CA",
+			Config:      &TLSConfig{CAFile: filepath.Join(dir, "other-ca.crt"), ServerName: "localhost"},
+			ExpectedErr: true,
+		},
+		{
+			Name:        "Wrong server name",
+			Config:      &TLSConfig{CAFile: filepath.Join(dir, "ca.crt"), ServerName: "gateway"},
+			ExpectedErr: true,
+		},
+		{
+			Name:        "IP address without server name",
+			Config:      &TLSConfig{CAFile: filepath.Join(dir, "ca.crt")},
+			ExpectedErr: true,
+		},
+		{
+			Name:   "Insecure skip verify",
+			Config: &TLSConfig{CAFile: filepath.Join(dir, "other-ca.crt"), InsecureSkipVerify: true},
+		},
+	}
+
+	for _, test := range TestCases {
+		t.Run(test.Name, func(t *testing.T) {
+			client := baseClient(&ControllerConfig{UpstreamTimeout: time.Second, TLS: test.Config})
+
+			res, err := client.Get(srv.URL)
+			if err == nil {
+				res.Body.Close()
+			}
+
+			if (err != nil) != test.ExpectedErr {
+				t.Errorf("Error - want: %t, got: %v", test.ExpectedErr, err)
+			}
+		})
+	}
+}
+
+func Test_TLSConfig_SharedByGatewayAndListClients(t *testing.T) {
+	ca := newTestCertificate(t, "ca", nil)
+	server := newTestCertificate(t, "localhost", ca)
+	client := newTestCertificate(t, "connector", ca)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.EnableHTTP2 = true
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.cert.Raw}, PrivateKey: server.key}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir := t.TempDir()
+	config := &ControllerConfig{
+		UpstreamTimeout: time.Second,
+		Transport:       TransportConfig{EnableHTTP2: true},
+		TLS: &TLSConfig{
+			CAFile:     filepath.Join(dir, "ca.crt"),
+			CertFile:   filepath.Join(dir, "tls.crt"),
+			KeyFile:    filepath.Join(dir, "tls.key"),
+			ServerName: "localhost",
+		},
+	}
+	writeFile(t, config.TLS.CAFile, ca.certPEM)
+	writeFile(t, config.TLS.CertFile, client.certPEM)
+	writeFile(t, config.TLS.KeyFile, client.keyPEM)
+
+	clients := []*http.Client{gatewayClient(config), listClient(config)}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(clients))
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *http.Client) {
+			defer wg.Done()
+
+			res, err := c.Get(srv.URL)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer res.Body.Close()
+
+			if res.ProtoMajor != 2 {
+				errs <- fmt.Errorf("protocol - want: HTTP/2, got: %s", res.Proto)
+			}
+		}(c)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("Request - want: no error, got: %s", err)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/openfaas/faas-provider/types"
+)
+
+// DefaultTopicAnnotation is the annotation which lists the topics of a
+// function when no other keys are configured.
+const DefaultTopicAnnotation = "topic"
+
+// AnnotationError is returned when the topics or options of a function
+// could not be read from one of its annotations or labels. The function is
+// not subscribed to any topic from a malformed value, and a malformed
+// option keeps the controller's setting.
+type AnnotationError struct {
+	Function  string
+	Namespace string
+
+	// Key of the annotation, or of the label when Label is true
+	Key   string
+	Label bool
+
+	Value string
+	Err   error
+}
+
+func (e *AnnotationError) Error() string {
+	kind := "annotation"
+	if e.Label {
+		kind = "label"
+	}
+
+	return fmt.Sprintf("malformed %s %s: %q on function: %s, error: %s",
+		kind, e.Key, e.Value, functionPath(e.Function, e.Namespace), e.Err)
+}
+
+func (e *AnnotationError) Unwrap() error {
+	return e.Err
+}
+
+// functionTopics reads the topics of a function from each of the builder's
+// annotation keys, falling back to labels with the same keys when none of
+// the annotations are set and TopicLabelFallback is true.
+func (s *FunctionLookupBuilder) functionTopics(function types.FunctionStatus, namespace string) ([]string, []AnnotationError) {
+	keys := s.TopicAnnotations
+	if len(keys) == 0 {
+		keys = []string{DefaultTopicAnnotation}
+	}
+
+	topics, errs, found := s.readTopics(function, namespace, keys, function.Annotations, false)
+	if !found && s.TopicLabelFallback {
+		topics, errs, _ = s.readTopics(function, namespace, keys, function.Labels, true)
+	}
+
+	return topics, errs
+}
+
+// readTopics reads the topics from each key which is set in values,
+// without duplicates. found is true when any of the keys is set.
+func (s *FunctionLookupBuilder) readTopics(function types.FunctionStatus, namespace string, keys []string, values *map[string]string, label bool) (topics []string, errs []AnnotationError, found bool) {
+	if values == nil {
+		return nil, nil, false
+	}
+
+	seen := map[string]bool{}
+	for _, key := range keys {
+		value, ok := (*values)[key]
+		if !ok {
+			continue
+		}
+		found = true
+
+		parsed, err := parseTopics(value, s.TopicDelimiter)
+		if err != nil {
+			errs = append(errs, AnnotationError{
+				Function:  function.Name,
+				Namespace: namespace,
+				Key:       key,
+				Label:     label,
+				Value:     value,
+				Err:       err,
+			})
+			continue
+		}
+
+		for _, topic := range parsed {
+			if !seen[topic] {
+				seen[topic] = true
+				topics = append(topics, topic)
+			}
+		}
+	}
+
+	return topics, errs, found
+}
+
+// parseTopics reads a JSON array of topics, or topics split by delimiter.
+// Empty topics in a delimited list are skipped, but the value is rejected
+// if any topic is not valid.
+func parseTopics(value, delimiter string) ([]string, error) {
+	var topics []string
+
+	if trimmed := strings.TrimSpace(value); strings.HasPrefix(trimmed, "[") {
+		if err := json.Unmarshal([]byte(trimmed), &topics); err != nil {
+			return nil, fmt.Errorf("invalid JSON array of topics: %w", err)
+		}
+
+		for i, topic := range topics {
+			topics[i] = strings.TrimSpace(topic)
+			if len(topics[i]) == 0 {
+				return nil, fmt.Errorf("empty topic at index %d", i)
+			}
+		}
+	} else if len(delimiter) > 0 {
+		topics = strings.Split(value, delimiter)
+	} else {
+		topics = []string{value}
+	}
+
+	parsed := make([]string, 0, len(topics))
+	for _, topic := range topics {
+		topic = strings.TrimSpace(topic)
+		if len(topic) == 0 {
+			continue
+		}
+
+		if err := validateTopic(topic); err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, topic)
+	}
+
+	return parsed, nil
+}
+
+// validateTopic checks that a topic has no empty segments, and that a
+// MultiSegmentWildcard is only used as the last segment.
+func validateTopic(topic string) error {
+	segments := strings.Split(topic, TopicSeparator)
+	for i, segment := range segments {
+		if len(segment) == 0 {
+			return fmt.Errorf("topic %q has an empty segment", topic)
+		}
+		if segment == MultiSegmentWildcard && i != len(segments)-1 {
+			return fmt.Errorf("topic %q may only use %s as its last segment", topic, MultiSegmentWildcard)
+		}
+	}
+
+	return nil
+}
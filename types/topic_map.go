@@ -4,53 +4,505 @@
 package types
 
 import (
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// TopicSeparator splits a topic into the segments used for wildcard matching
+	TopicSeparator = "."
+
+	// SingleSegmentWildcard matches exactly one segment of a topic i.e. "payment.*"
+	SingleSegmentWildcard = "*"
+
+	// MultiSegmentWildcard matches one or more trailing segments of a topic
+	// and may only appear as the last segment i.e. "orders.>"
+	MultiSegmentWildcard = ">"
+
+	// matchCacheSize bounds the number of merged wildcard results cached
+	// per index. Results are cached per set of matching patterns, not per
+	// topic, so it is only reached by a map with many overlapping patterns.
+	matchCacheSize = 4096
+
+	// maxStackMatches is the number of wildcard patterns a topic can match
+	// before Match has to allocate to collect them.
+	maxStackMatches = 16
 )
 
 func NewTopicMap() TopicMap {
-	lookup := make(map[string][]string)
-	return TopicMap{
-		lookup: &lookup,
-		lock:   sync.RWMutex{},
-	}
+	return TopicMap{}
 }
 
+// TopicMap holds the functions which subscribe to each topic. Keys may
+// contain NATS-style wildcards, see SingleSegmentWildcard and
+// MultiSegmentWildcard.
+//
+// Sync builds an immutable index which is swapped in atomically, so Match
+// and Topics never take a lock. Match does not allocate, unless a topic
+// matches more than maxStackMatches patterns, or the first time a topic
+// matches a set of several patterns.
 type TopicMap struct {
-	lookup *map[string][]string
-	lock   sync.RWMutex
+	// index holds the current *topicIndex
+	index atomic.Value
+
+	// lock serializes writers
+	lock sync.Mutex
+
+	// listeners are notified of changes, guarded by lock
+	listeners []TopicMapListener
 }
 
+// Match returns the functions which subscribe to topicName. Functions
+// subscribed to the exact topic come first, followed by functions
+// subscribed via wildcard patterns ordered from the most to the least
+// specific pattern. A function matched by several keys is only returned
+// once, at the position of its most specific match.
+//
+// The returned slice is shared and must not be modified.
 func (t *TopicMap) Match(topicName string) []string {
-	t.lock.RLock()
-	defer t.lock.RUnlock()
+	return t.load().match(topicName)
+}
 
-	var values []string
+// Sync replaces the functions subscribed to each topic, and passes the
+// changes to any listeners added with AddListener.
+func (t *TopicMap) Sync(updated *map[string][]string) {
+	t.SyncFunctions(updated, nil)
+}
 
-	for key, val := range *t.lookup {
-		if key == topicName {
-			values = val
-			break
-		}
-	}
+// SyncFunctions replaces the functions subscribed to each topic like Sync,
+// along with the metadata of each function, keyed by the name returned by
+// Match.
+func (t *TopicMap) SyncFunctions(updated *map[string][]string, functions map[string]FunctionMetadata) {
+	index := newTopicIndex(*updated)
+	index.functions = functions
+	index.syncedAt = time.Now()
 
-	return values
+	t.store(index, 0)
 }
 
-func (t *TopicMap) Sync(updated *map[string][]string) {
+// store swaps in index and notifies listeners. A generation of zero
+// follows on from the current one.
+func (t *TopicMap) store(index *topicIndex, generation uint64) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
-	t.lookup = updated
+	previous := t.load()
+	if generation == 0 {
+		generation = previous.generation + 1
+	}
+	index.generation = generation
+
+	t.index.Store(index)
+
+	if len(t.listeners) == 0 {
+		return
+	}
+
+	if diff := diffLookups(previous.lookup, index.lookup); !diff.Empty() {
+		for _, listener := range t.listeners {
+			listener.TopicMapChanged(diff)
+		}
+	}
+}
+
+// Function returns the metadata of a function returned by Match, if its
+// source provided any.
+func (t *TopicMap) Function(name string) (FunctionMetadata, bool) {
+	function, ok := t.load().functions[name]
+	return function, ok
+}
+
+// Generation is incremented each time the map is synced, it is zero until
+// the first sync.
+func (t *TopicMap) Generation() uint64 {
+	return t.load().generation
 }
 
 func (t *TopicMap) Topics() []string {
-	t.lock.RLock()
-	defer t.lock.RUnlock()
+	lookup := t.load().lookup
 
-	topics := make([]string, 0, len(*t.lookup))
-	for topic := range *t.lookup {
+	topics := make([]string, 0, len(lookup))
+	for topic := range lookup {
 		topics = append(topics, topic)
 	}
 
 	return topics
 }
+
+func (t *TopicMap) load() *topicIndex {
+	if index, ok := t.index.Load().(*topicIndex); ok {
+		return index
+	}
+	return emptyTopicIndex
+}
+
+var emptyTopicIndex = newTopicIndex(map[string][]string{})
+
+// topicIndex is an immutable view of a synced lookup. Every key of the
+// lookup is held in exact, with the functions of any matching wildcard
+// patterns already merged in for literal keys. Other topics are resolved
+// by walking the trie of wildcard patterns.
+type topicIndex struct {
+	lookup map[string][]string
+	exact  map[string][]string
+	root   *topicNode
+
+	// functions holds the metadata of each function, if known
+	functions map[string]FunctionMetadata
+
+	// generation and syncedAt identify the sync which built the index
+	generation uint64
+	syncedAt   time.Time
+
+	// cache holds a map[matchKey][]string of merged results for each set
+	// of patterns matched by topics which are not in exact. It is copied
+	// on write, guarded by cacheLock.
+	cache     atomic.Value
+	cacheLock sync.Mutex
+}
+
+// topicNode is a segment of the wildcard pattern trie
+type topicNode struct {
+	children map[string]*topicNode
+	single   *topicNode
+
+	// pattern ends at this node
+	pattern *topicPattern
+
+	// tail is a pattern ending with MultiSegmentWildcard at this node
+	tail *topicPattern
+}
+
+// topicPattern is a wildcard key from the lookup
+type topicPattern struct {
+	key      string
+	segments []string
+
+	// rank orders patterns by descending specificity
+	rank int
+
+	// functions subscribed to the pattern, without duplicates
+	functions []string
+}
+
+func newTopicIndex(lookup map[string][]string) *topicIndex {
+	index := &topicIndex{
+		lookup: lookup,
+		exact:  make(map[string][]string, len(lookup)),
+	}
+	index.cache.Store(map[matchKey][]string{})
+
+	patterns := compilePatterns(lookup)
+	if len(patterns) > 0 {
+		index.root = &topicNode{}
+		for _, pattern := range patterns {
+			index.root.insert(pattern)
+		}
+	}
+
+	for key, functions := range lookup {
+		if index.root == nil || isPattern(key) {
+			index.exact[key] = functions
+			continue
+		}
+
+		var matched patternMatches
+		index.root.collect(key, &matched)
+		if matched.len() == 0 {
+			index.exact[key] = functions
+			continue
+		}
+
+		index.exact[key] = mergeFunctions(functions, matched.slice())
+	}
+
+	return index
+}
+
+func (index *topicIndex) match(topic string) []string {
+	if functions, ok := index.exact[topic]; ok {
+		return functions
+	}
+
+	if index.root == nil || isPattern(topic) {
+		return nil
+	}
+
+	var matched patternMatches
+	index.root.collect(topic, &matched)
+
+	switch matched.len() {
+	case 0:
+		return nil
+	case 1:
+		return matched.patterns[0].functions
+	}
+
+	key, ok := matched.key()
+	if !ok {
+		return mergeFunctions(nil, matched.slice())
+	}
+
+	cache := index.cache.Load().(map[matchKey][]string)
+	if functions, ok := cache[key]; ok {
+		return functions
+	}
+
+	functions := mergeFunctions(nil, matched.slice())
+	index.store(key, functions)
+	return functions
+}
+
+// store adds the functions for a set of patterns to the cache, unless it
+// is full.
+func (index *topicIndex) store(key matchKey, functions []string) {
+	index.cacheLock.Lock()
+	defer index.cacheLock.Unlock()
+
+	cache := index.cache.Load().(map[matchKey][]string)
+	if _, ok := cache[key]; ok || len(cache) >= matchCacheSize {
+		return
+	}
+
+	updated := make(map[matchKey][]string, len(cache)+1)
+	for k, v := range cache {
+		updated[k] = v
+	}
+	updated[key] = functions
+
+	index.cache.Store(updated)
+}
+
+func (n *topicNode) insert(pattern *topicPattern) {
+	node := n
+	for i, segment := range pattern.segments {
+		last := i == len(pattern.segments)-1
+
+		if segment == MultiSegmentWildcard && last {
+			if node.tail == nil {
+				node.tail = pattern
+			}
+			return
+		}
+
+		if segment == SingleSegmentWildcard {
+			if node.single == nil {
+				node.single = &topicNode{}
+			}
+			node = node.single
+			continue
+		}
+
+		if node.children == nil {
+			node.children = map[string]*topicNode{}
+		}
+		child, ok := node.children[segment]
+		if !ok {
+			child = &topicNode{}
+			node.children[segment] = child
+		}
+		node = child
+	}
+
+	if node.pattern == nil {
+		node.pattern = pattern
+	}
+}
+
+// collect adds every pattern matching the remaining segments of topic
+// to matched.
+func (n *topicNode) collect(topic string, matched *patternMatches) {
+	if n.tail != nil && len(topic) > 0 {
+		matched.add(n.tail)
+	}
+
+	segment, rest, more := strings.Cut(topic, TopicSeparator)
+
+	if !more {
+		if child := n.children[segment]; child != nil && child.pattern != nil {
+			matched.add(child.pattern)
+		}
+		if n.single != nil && n.single.pattern != nil {
+			matched.add(n.single.pattern)
+		}
+		return
+	}
+
+	if child := n.children[segment]; child != nil {
+		child.collect(rest, matched)
+	}
+	if n.single != nil {
+		n.single.collect(rest, matched)
+	}
+}
+
+// patternMatches collects the patterns matching a topic on the stack,
+// only allocating when more than maxStackMatches patterns match.
+type patternMatches struct {
+	patterns [maxStackMatches]*topicPattern
+	n        int
+	overflow []*topicPattern
+}
+
+func (m *patternMatches) add(pattern *topicPattern) {
+	if m.n < len(m.patterns) {
+		m.patterns[m.n] = pattern
+		m.n++
+		return
+	}
+	m.overflow = append(m.overflow, pattern)
+}
+
+func (m *patternMatches) len() int {
+	return m.n + len(m.overflow)
+}
+
+// matchKey identifies a set of matched patterns by their rank plus one in
+// ascending order, with unused entries left as zero, so that every topic
+// matching the same patterns shares one merged result.
+type matchKey [maxStackMatches]int
+
+// key returns the matchKey of the matched patterns, or false if there
+// are too many to fit in one.
+func (m *patternMatches) key() (matchKey, bool) {
+	var key matchKey
+	if len(m.overflow) > 0 {
+		return key, false
+	}
+
+	for i := 0; i < m.n; i++ {
+		rank := m.patterns[i].rank + 1
+
+		// insertion sort, since sort.Ints would move key to the heap
+		j := i
+		for ; j > 0 && key[j-1] > rank; j-- {
+			key[j] = key[j-1]
+		}
+		key[j] = rank
+	}
+
+	return key, true
+}
+
+// slice copies the matched patterns to the heap
+func (m *patternMatches) slice() []*topicPattern {
+	matched := make([]*topicPattern, 0, m.len())
+	matched = append(matched, m.patterns[:m.n]...)
+	return append(matched, m.overflow...)
+}
+
+// compilePatterns extracts the wildcard keys from lookup and ranks them
+// by descending specificity so that Match can apply its precedence rules.
+func compilePatterns(lookup map[string][]string) []*topicPattern {
+	var patterns []*topicPattern
+	for key, functions := range lookup {
+		if isPattern(key) {
+			patterns = append(patterns, &topicPattern{
+				key:       key,
+				segments:  strings.Split(key, TopicSeparator),
+				functions: mergeFunctions(functions, nil),
+			})
+		}
+	}
+
+	sort.Slice(patterns, func(i, j int) bool {
+		return lessSpecific(patterns[j], patterns[i])
+	})
+
+	for i, pattern := range patterns {
+		pattern.rank = i
+	}
+
+	return patterns
+}
+
+// lessSpecific reports whether a is a less specific pattern than b. A
+// pattern with more literal segments is more specific, then a pattern
+// without a trailing MultiSegmentWildcard, then a longer pattern, then
+// the pattern whose first literal segment comes earlier. Ties are broken
+// by the key so that the order is deterministic.
+func lessSpecific(a, b *topicPattern) bool {
+	aLiterals, bLiterals := countLiterals(a.segments), countLiterals(b.segments)
+	if aLiterals != bLiterals {
+		return aLiterals < bLiterals
+	}
+
+	aTail, bTail := hasTailWildcard(a.segments), hasTailWildcard(b.segments)
+	if aTail != bTail {
+		return aTail
+	}
+
+	if len(a.segments) != len(b.segments) {
+		return len(a.segments) < len(b.segments)
+	}
+
+	for i := range a.segments {
+		aWildcard, bWildcard := a.segments[i] == SingleSegmentWildcard, b.segments[i] == SingleSegmentWildcard
+		if aWildcard != bWildcard {
+			return aWildcard
+		}
+	}
+
+	return a.key > b.key
+}
+
+func countLiterals(segments []string) int {
+	n := 0
+	for _, segment := range segments {
+		if segment != SingleSegmentWildcard && segment != MultiSegmentWildcard {
+			n++
+		}
+	}
+	return n
+}
+
+func hasTailWildcard(segments []string) bool {
+	return len(segments) > 0 && segments[len(segments)-1] == MultiSegmentWildcard
+}
+
+// isPattern reports whether topic contains a wildcard segment.
+func isPattern(topic string) bool {
+	for len(topic) > 0 {
+		var segment string
+		segment, topic, _ = strings.Cut(topic, TopicSeparator)
+		if segment == SingleSegmentWildcard || segment == MultiSegmentWildcard {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeFunctions concatenates exact with the functions of each pattern in
+// order of rank, dropping any function which has already been seen.
+func mergeFunctions(exact []string, matched []*topicPattern) []string {
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].rank < matched[j].rank
+	})
+
+	size := len(exact)
+	for _, pattern := range matched {
+		size += len(pattern.functions)
+	}
+
+	seen := make(map[string]bool, size)
+	values := make([]string, 0, size)
+
+	add := func(functions []string) {
+		for _, function := range functions {
+			if !seen[function] {
+				seen[function] = true
+				values = append(values, function)
+			}
+		}
+	}
+
+	add(exact)
+	for _, pattern := range matched {
+		add(pattern.functions)
+	}
+
+	return values
+}
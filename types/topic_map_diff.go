@@ -0,0 +1,109 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"sort"
+)
+
+// TopicMapDiff describes how a TopicMap changed when it was synced. Topics
+// and functions are sorted.
+type TopicMapDiff struct {
+	// AddedTopics have at least one function subscribed for the first time
+	AddedTopics []string
+
+	// RemovedTopics no longer have any functions subscribed
+	RemovedTopics []string
+
+	// AddedFunctions holds the functions newly subscribed to each topic,
+	// including every function of an added topic.
+	AddedFunctions map[string][]string
+
+	// RemovedFunctions holds the functions no longer subscribed to each
+	// topic, including every function of a removed topic.
+	RemovedFunctions map[string][]string
+}
+
+// Empty reports whether nothing changed
+func (d TopicMapDiff) Empty() bool {
+	return len(d.AddedFunctions) == 0 && len(d.RemovedFunctions) == 0
+}
+
+// TopicMapListener is notified each time a sync changes a TopicMap, for
+// instance so that a connector can subscribe to, and unsubscribe from,
+// topics at its broker as functions are deployed and removed.
+//
+// Listeners are called one at a time in the order the changes were made,
+// from the goroutine which called Sync. They must not block or call Sync.
+type TopicMapListener interface {
+	TopicMapChanged(diff TopicMapDiff)
+}
+
+// AddListener registers a listener for changes to the map. If the map is
+// not empty, the listener is first passed every current topic as added.
+func (t *TopicMap) AddListener(listener TopicMapListener) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.listeners = append(t.listeners, listener)
+
+	if diff := diffLookups(nil, t.load().lookup); !diff.Empty() {
+		listener.TopicMapChanged(diff)
+	}
+}
+
+// diffLookups compares the functions subscribed to each topic before and
+// after a sync.
+func diffLookups(before, after map[string][]string) TopicMapDiff {
+	diff := TopicMapDiff{
+		AddedFunctions:   map[string][]string{},
+		RemovedFunctions: map[string][]string{},
+	}
+
+	for topic, functions := range after {
+		previous, existed := before[topic]
+		if added := missingFunctions(functions, previous); len(added) > 0 {
+			diff.AddedFunctions[topic] = added
+			if !existed || len(previous) == 0 {
+				diff.AddedTopics = append(diff.AddedTopics, topic)
+			}
+		}
+	}
+
+	for topic, functions := range before {
+		current := after[topic]
+		if removed := missingFunctions(functions, current); len(removed) > 0 {
+			diff.RemovedFunctions[topic] = removed
+			if len(current) == 0 {
+				diff.RemovedTopics = append(diff.RemovedTopics, topic)
+			}
+		}
+	}
+
+	sort.Strings(diff.AddedTopics)
+	sort.Strings(diff.RemovedTopics)
+
+	return diff
+}
+
+// missingFunctions returns the sorted functions in a which are not in b,
+// without duplicates.
+func missingFunctions(a, b []string) []string {
+	var missing []string
+
+	seen := make(map[string]bool, len(a)+len(b))
+	for _, function := range b {
+		seen[function] = true
+	}
+
+	for _, function := range a {
+		if !seen[function] {
+			seen[function] = true
+			missing = append(missing, function)
+		}
+	}
+
+	sort.Strings(missing)
+	return missing
+}
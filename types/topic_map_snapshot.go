@@ -0,0 +1,103 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// TopicMapSnapshot is a copy of a synced TopicMap, which can be persisted
+// so that a connector which restarts while the gateway is unavailable can
+// still route messages.
+type TopicMapSnapshot struct {
+	// Generation of the TopicMap when the snapshot was taken
+	Generation uint64 `json:"generation"`
+
+	// SyncedAt is when the TopicMap was synced
+	SyncedAt time.Time `json:"syncedAt"`
+
+	// Topics holds the functions subscribed to each topic
+	Topics map[string][]string `json:"topics"`
+
+	// Functions holds the metadata of each function, if known
+	Functions map[string]FunctionMetadata `json:"functions,omitempty"`
+}
+
+// Snapshot returns a copy of the current map. It must not be modified.
+func (t *TopicMap) Snapshot() TopicMapSnapshot {
+	index := t.load()
+
+	return TopicMapSnapshot{
+		Generation: index.generation,
+		SyncedAt:   index.syncedAt,
+		Topics:     index.lookup,
+		Functions:  index.functions,
+	}
+}
+
+// Restore replaces the map with a snapshot, keeping its generation, and
+// passes the changes to any listeners.
+func (t *TopicMap) Restore(snapshot TopicMapSnapshot) {
+	topics := snapshot.Topics
+	if topics == nil {
+		topics = map[string][]string{}
+	}
+
+	index := newTopicIndex(topics)
+	index.functions = snapshot.Functions
+	index.syncedAt = snapshot.SyncedAt
+
+	t.store(index, snapshot.Generation)
+}
+
+// WriteTopicMapSnapshot writes snapshot to the file at path as JSON. The
+// file is replaced atomically, so a reader never sees a partial snapshot.
+func WriteTopicMapSnapshot(path string, snapshot TopicMapSnapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// ReadTopicMapSnapshot reads a snapshot written by WriteTopicMapSnapshot
+func ReadTopicMapSnapshot(path string) (TopicMapSnapshot, error) {
+	var snapshot TopicMapSnapshot
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return snapshot, err
+	}
+
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return snapshot, fmt.Errorf("unable to parse topic map snapshot: %s, error: %w", path, err)
+	}
+
+	return snapshot, nil
+}
@@ -0,0 +1,163 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_TopicMapSnapshot_RoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+
+	topicMap := NewTopicMap()
+	lookup := map[string][]string{"orders": {"billing.openfaas-fn"}}
+	functions := map[string]FunctionMetadata{
+		"billing.openfaas-fn": {Name: "billing", Namespace: "openfaas-fn", Topics: []string{"orders"}},
+	}
+	topicMap.Sync(&lookup)
+	topicMap.SyncFunctions(&lookup, functions)
+
+	if err := WriteTopicMapSnapshot(path, topicMap.Snapshot()); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := ReadTopicMapSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewTopicMap()
+	restored.Restore(snapshot)
+
+	if restored.Generation() != 2 {
+		t.Errorf("Generation - want: %d, got: %d", 2, restored.Generation())
+	}
+	if got := restored.Match("orders"); !reflect.DeepEqual(got, lookup["orders"]) {
+		t.Errorf("Match - want: %v, got: %v", lookup["orders"], got)
+	}
+	if got, _ := restored.Function("billing.openfaas-fn"); !reflect.DeepEqual(got, functions["billing.openfaas-fn"]) {
+		t.Errorf("Function - want: %+v, got: %+v", functions["billing.openfaas-fn"], got)
+	}
+
+	restored.Sync(&lookup)
+	if restored.Generation() != 3 {
+		t.Errorf("Generation after sync - want: %d, got: %d", 3, restored.Generation())
+	}
+}
+
+func Test_Controller_RestoresStaleSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	snapshotPath := filepath.Join(dir, "snapshot.json")
+	sourcePath := filepath.Join(dir, "topics.yaml")
+
+	if err := os.WriteFile(sourcePath, []byte("orders:\n- billing\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ControllerConfig{
+		RebuildInterval: time.Hour,
+		FunctionSource:  NewFileFunctionSource(sourcePath),
+		SnapshotPath:    snapshotPath,
+	}
+
+	first := NewController(nil, config).(*controller)
+	first.syncLookups(config.FunctionSource, first.TopicMap)
+
+	// the source is unavailable when the connector restarts
+	if err := os.Remove(sourcePath); err != nil {
+		t.Fatal(err)
+	}
+
+	second := NewController(nil, config).(*controller)
+
+	status := second.SyncStatus()
+	if !status.Stale || status.Generation != 1 {
+		t.Errorf("Restored status - want: stale generation %d, got: stale %t generation %d", 1, status.Stale, status.Generation)
+	}
+	if got := second.TopicMap.Match("orders"); !reflect.DeepEqual(got, []string{"billing"}) {
+		t.Errorf("Restored match - want: %v, got: %v", []string{"billing"}, got)
+	}
+
+	second.syncLookups(config.FunctionSource, second.TopicMap)
+	if status := second.SyncStatus(); !status.Stale {
+		t.Errorf("Stale after failed sync - want: %t, got: %t", true, status.Stale)
+	}
+
+	if err := os.WriteFile(sourcePath, []byte("orders:\n- shipping\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	second.syncLookups(config.FunctionSource, second.TopicMap)
+	status = second.SyncStatus()
+	if status.Stale || status.Generation != 2 {
+		t.Errorf("Status after sync - want: fresh generation %d, got: stale %t generation %d", 2, status.Stale, status.Generation)
+	}
+}
+
+func Test_Controller_SnapshotKeepsFailedNamespace(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/system/namespaces" {
+			_, _ = w.Write([]byte(`["payments", "search"]`))
+			return
+		}
+
+		if r.URL.Query().Get("namespace") == "search" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(`[{"name": "charge", "namespace": "payments", "annotations": {"topic": "orders"}}]`))
+	}))
+	defer srv.Close()
+
+	snapshotPath := filepath.Join(t.TempDir(), "snapshot.json")
+	err := WriteTopicMapSnapshot(snapshotPath, TopicMapSnapshot{
+		Generation: 1,
+		Topics: map[string][]string{
+			"orders":  {"charge.payments", "index.search"},
+			"queries": {"index.search"},
+		},
+		Functions: map[string]FunctionMetadata{
+			"charge.payments": {Name: "charge", Namespace: "payments", Topics: []string{"orders"}},
+			"index.search":    {Name: "index", Namespace: "search", Topics: []string{"orders", "queries"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewController(nil, &ControllerConfig{
+		GatewayURL:      srv.URL,
+		UpstreamTimeout: time.Second,
+		RebuildInterval: time.Hour,
+		SnapshotPath:    snapshotPath,
+	}).(*controller)
+
+	c.BeginMapBuilder()
+	defer c.Shutdown(context.Background())
+
+	deadline := time.Now().Add(time.Second)
+	for c.SyncStatus().Generation < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Generation - want: %d, got: %d", 2, c.SyncStatus().Generation)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	want := map[string][]string{
+		"orders":  {"charge.payments", "index.search"},
+		"queries": {"index.search"},
+	}
+	for topic, functions := range want {
+		if got := c.TopicMap.Match(topic); !reflect.DeepEqual(got, functions) {
+			t.Errorf("Match %s - want: %v, got: %v", topic, functions, got)
+		}
+	}
+}
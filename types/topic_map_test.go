@@ -0,0 +1,354 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func Test_TopicMap_Match(t *testing.T) {
+	lookup := map[string][]string{
+		"payment.received":   {"exact.openfaas-fn"},
+		"payment.*":          {"single.openfaas-fn", "exact.openfaas-fn"},
+		"payment.>":          {"tail.openfaas-fn", "single.openfaas-fn"},
+		">":                  {"all.openfaas-fn"},
+		"*.received":         {"received.openfaas-fn"},
+		"orders.*.shipped":   {"shipped.openfaas-fn"},
+		"orders.eu.>":        {"eu.openfaas-fn"},
+		"orders.eu.shipped":  {"eu-shipped.openfaas-fn"},
+		"unrelated.topic.>":  {"unrelated.openfaas-fn"},
+		"payment.received.*": {"deeper.openfaas-fn"},
+	}
+
+	topicMap := NewTopicMap()
+	topicMap.Sync(&lookup)
+
+	var TestCases = []struct {
+		Name     string
+		Topic    string
+		Expected []string
+	}{
+		{
+			Name:  "Exact match comes before wildcards and duplicates are removed",
+			Topic: "payment.received",
+			Expected: []string{
+				"exact.openfaas-fn",
+				"single.openfaas-fn",
+				"received.openfaas-fn",
+				"tail.openfaas-fn",
+				"all.openfaas-fn",
+			},
+		},
+		{
+			Name:  "Wildcards only",
+			Topic: "payment.refunded",
+			Expected: []string{
+				"single.openfaas-fn",
+				"exact.openfaas-fn",
+				"tail.openfaas-fn",
+				"all.openfaas-fn",
+			},
+		},
+		{
+			Name:  "Tail wildcard matches several segments",
+			Topic: "payment.refunded.partial",
+			Expected: []string{
+				"tail.openfaas-fn",
+				"single.openfaas-fn",
+				"all.openfaas-fn",
+			},
+		},
+		{
+			Name:  "More literal segments win",
+			Topic: "orders.eu.shipped",
+			Expected: []string{
+				"eu-shipped.openfaas-fn",
+				"shipped.openfaas-fn",
+				"eu.openfaas-fn",
+				"all.openfaas-fn",
+			},
+		},
+		{
+			Name:     "Tail wildcard needs at least one segment",
+			Topic:    "unrelated.topic",
+			Expected: []string{"all.openfaas-fn"},
+		},
+		{
+			Name:     "Wildcards in the published topic are not expanded",
+			Topic:    "payment.*",
+			Expected: []string{"single.openfaas-fn", "exact.openfaas-fn"},
+		},
+	}
+
+	for _, test := range TestCases {
+		t.Run(test.Name, func(t *testing.T) {
+			got := topicMap.Match(test.Topic)
+			if !reflect.DeepEqual(got, test.Expected) {
+				t.Errorf("Match(%q) - want: %v, got: %v", test.Topic, test.Expected, got)
+			}
+		})
+	}
+}
+
+func Test_TopicMap_MatchSegments(t *testing.T) {
+	var TestCases = []struct {
+		Pattern  string
+		Topic    string
+		Expected bool
+	}{
+		{Pattern: "a.*", Topic: "a.b", Expected: true},
+		{Pattern: "a.*", Topic: "a", Expected: false},
+		{Pattern: "a.*", Topic: "a.b.c", Expected: false},
+		{Pattern: "a.>", Topic: "a.b.c", Expected: true},
+		{Pattern: "a.>", Topic: "a", Expected: false},
+		{Pattern: "*.*", Topic: "a.b", Expected: true},
+		{Pattern: ">.a", Topic: "b.a", Expected: false},
+	}
+
+	for _, test := range TestCases {
+		lookup := map[string][]string{test.Pattern: {"fn"}}
+		topicMap := NewTopicMap()
+		topicMap.Sync(&lookup)
+
+		if got := len(topicMap.Match(test.Topic)) == 1; got != test.Expected {
+			t.Errorf("pattern %q, topic %q - want match: %t, got: %t", test.Pattern, test.Topic, test.Expected, got)
+		}
+	}
+}
+
+func Test_TopicMap_MatchDoesNotAllocate(t *testing.T) {
+	lookup := map[string][]string{
+		"payment.received": {"exact"},
+		"payment.*":        {"single"},
+		"payment.>":        {"tail"},
+		"orders.>":         {"orders"},
+	}
+
+	topicMap := NewTopicMap()
+	topicMap.Sync(&lookup)
+
+	for _, topic := range []string{"payment.received", "payment.refunded", "orders.eu.shipped", "unknown"} {
+		// the first call may populate the cache
+		topicMap.Match(topic)
+
+		allocs := testing.AllocsPerRun(100, func() {
+			topicMap.Match(topic)
+		})
+		if allocs != 0 {
+			t.Errorf("Match(%q) - want: 0 allocations, got: %f", topic, allocs)
+		}
+	}
+}
+
+func Test_TopicMap_MatchDistinctTopicsDoesNotAllocate(t *testing.T) {
+	lookup := map[string][]string{
+		"orders.*":    {"single"},
+		"orders.>":    {"tail"},
+		"*.created":   {"created"},
+		"orders.*.eu": {"eu"},
+	}
+
+	topicMap := NewTopicMap()
+	topicMap.Sync(&lookup)
+
+	topics := make([]string, 1000)
+	for i := range topics {
+		topics[i] = fmt.Sprintf("orders.%d", i)
+	}
+
+	// the first topic populates the cache for the set of patterns
+	if got := topicMap.Match(topics[0]); !reflect.DeepEqual(got, []string{"single", "tail"}) {
+		t.Fatalf("Match - want: %v, got: %v", []string{"single", "tail"}, got)
+	}
+
+	i := 0
+	allocs := testing.AllocsPerRun(len(topics), func() {
+		i++
+		topicMap.Match(topics[i%len(topics)])
+	})
+	if allocs != 0 {
+		t.Errorf("Match of distinct topics - want: 0 allocations, got: %f", allocs)
+	}
+
+	cache := topicMap.load().cache.Load().(map[matchKey][]string)
+	if len(cache) != 1 {
+		t.Errorf("Cached results - want: %d, got: %d", 1, len(cache))
+	}
+}
+
+func Test_TopicMap_ZeroValue(t *testing.T) {
+	topicMap := TopicMap{}
+
+	if got := topicMap.Match("topic1"); len(got) != 0 {
+		t.Errorf("Match - want: no functions, got: %v", got)
+	}
+	if got := topicMap.Topics(); len(got) != 0 {
+		t.Errorf("Topics - want: no topics, got: %v", got)
+	}
+}
+
+// linearMatch is the lookup TopicMap used before it was indexed, kept
+// as a baseline for the benchmarks.
+func linearMatch(lookup map[string][]string, topicName string) []string {
+	var values []string
+	for key, val := range lookup {
+		if key == topicName {
+			values = val
+			break
+		}
+	}
+	return values
+}
+
+func benchmarkLookup(topics int) map[string][]string {
+	lookup := make(map[string][]string, topics)
+	for i := 0; i < topics; i++ {
+		lookup[fmt.Sprintf("service%d.event%d", i%50, i)] = []string{fmt.Sprintf("fn%d.openfaas-fn", i)}
+	}
+	lookup["service1.*"] = []string{"audit.openfaas-fn"}
+	lookup["service2.>"] = []string{"archive.openfaas-fn", "audit.openfaas-fn"}
+	return lookup
+}
+
+func BenchmarkTopicMap_Match(b *testing.B) {
+	for _, size := range []int{10, 1000, 10000} {
+		lookup := benchmarkLookup(size)
+		topicMap := NewTopicMap()
+		topicMap.Sync(&lookup)
+
+		topic := fmt.Sprintf("service%d.event%d", (size-1)%50, size-1)
+
+		b.Run(fmt.Sprintf("indexed/%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				topicMap.Match(topic)
+			}
+		})
+
+		b.Run(fmt.Sprintf("linear/%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				linearMatch(lookup, topic)
+			}
+		})
+	}
+}
+
+func BenchmarkTopicMap_MatchWildcard(b *testing.B) {
+	lookup := benchmarkLookup(10000)
+	topicMap := NewTopicMap()
+	topicMap.Sync(&lookup)
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			topicMap.Match("service2.unknown.event")
+		}
+	})
+}
+
+func BenchmarkTopicMap_MatchDistinctTopics(b *testing.B) {
+	lookup := benchmarkLookup(10000)
+	lookup["service2.*"] = []string{"metrics.openfaas-fn"}
+	topicMap := NewTopicMap()
+	topicMap.Sync(&lookup)
+
+	topics := make([]string, 100000)
+	for i := range topics {
+		topics[i] = fmt.Sprintf("service2.order%d", i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		topicMap.Match(topics[i%len(topics)])
+	}
+}
+
+func Test_TopicMap_SyncNotifiesListeners(t *testing.T) {
+	topicMap := NewTopicMap()
+
+	initial := map[string][]string{
+		"orders":   {"fn1"},
+		"payments": {"fn2"},
+	}
+	topicMap.Sync(&initial)
+
+	listener := &topicMapRecorder{}
+	topicMap.AddListener(listener)
+
+	var TestCases = []struct {
+		Name     string
+		Lookup   map[string][]string
+		Expected []TopicMapDiff
+	}{
+		{
+			Name: "Unchanged map is not notified",
+			Lookup: map[string][]string{
+				"orders":   {"fn1"},
+				"payments": {"fn2"},
+			},
+		},
+		{
+			Name: "Topics and functions added and removed",
+			Lookup: map[string][]string{
+				"orders":  {"fn1", "fn3"},
+				"refunds": {"fn2"},
+			},
+			Expected: []TopicMapDiff{{
+				AddedTopics:      []string{"refunds"},
+				RemovedTopics:    []string{"payments"},
+				AddedFunctions:   map[string][]string{"orders": {"fn3"}, "refunds": {"fn2"}},
+				RemovedFunctions: map[string][]string{"payments": {"fn2"}},
+			}},
+		},
+		{
+			Name: "Function removed from a topic which remains",
+			Lookup: map[string][]string{
+				"orders":  {"fn3"},
+				"refunds": {"fn2"},
+			},
+			Expected: []TopicMapDiff{{
+				AddedFunctions:   map[string][]string{},
+				RemovedFunctions: map[string][]string{"orders": {"fn1"}},
+			}},
+		},
+	}
+
+	// the listener is first passed the existing topics
+	want := TopicMapDiff{
+		AddedTopics:      []string{"orders", "payments"},
+		AddedFunctions:   map[string][]string{"orders": {"fn1"}, "payments": {"fn2"}},
+		RemovedFunctions: map[string][]string{},
+	}
+	if len(listener.diffs) != 1 || !reflect.DeepEqual(listener.diffs[0], want) {
+		t.Fatalf("Initial diff - want: %+v, got: %+v", want, listener.diffs)
+	}
+
+	for _, test := range TestCases {
+		t.Run(test.Name, func(t *testing.T) {
+			listener.diffs = nil
+			topicMap.Sync(&test.Lookup)
+
+			if len(listener.diffs) != len(test.Expected) {
+				t.Fatalf("Diffs - want: %d, got: %d", len(test.Expected), len(listener.diffs))
+			}
+			for i, diff := range listener.diffs {
+				if !reflect.DeepEqual(diff, test.Expected[i]) {
+					t.Errorf("Diff %d - want: %+v, got: %+v", i, test.Expected[i], diff)
+				}
+			}
+		})
+	}
+}
+
+type topicMapRecorder struct {
+	diffs []TopicMapDiff
+}
+
+func (r *topicMapRecorder) TopicMapChanged(diff TopicMapDiff) {
+	r.diffs = append(r.diffs, diff)
+}
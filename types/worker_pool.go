@@ -0,0 +1,98 @@
+// Copyright (c) OpenFaaS Author(s) 2019. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"context"
+	"sync"
+)
+
+// workerPool bounds the number of invocations in flight across every
+// topic. A nil workerPool does not impose a limit.
+type workerPool struct {
+	slots chan struct{}
+}
+
+func newWorkerPool(size int) *workerPool {
+	if size <= 0 {
+		return nil
+	}
+
+	return &workerPool{
+		slots: make(chan struct{}, size),
+	}
+}
+
+// acquire blocks until a slot is free or ctx is done.
+func (p *workerPool) acquire(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if p == nil {
+		return nil
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees a slot taken by acquire.
+func (p *workerPool) release() {
+	if p == nil {
+		return
+	}
+	<-p.slots
+}
+
+// fanOut runs work for each of n items using up to parallelism workers,
+// each of which must acquire a slot from pool. Items which have not
+// started when ctx is done are passed to cancelled instead. fanOut returns
+// when every item has been handled.
+func fanOut(ctx context.Context, pool *workerPool, parallelism, n int, work func(int), cancelled func(int, error)) {
+	run := func(item int) {
+		if err := pool.acquire(ctx); err != nil {
+			cancelled(item, err)
+			return
+		}
+		defer pool.release()
+
+		work(item)
+	}
+
+	if parallelism > n {
+		parallelism = n
+	}
+
+	if parallelism <= 1 {
+		for item := 0; item < n; item++ {
+			run(item)
+		}
+		return
+	}
+
+	jobs := make(chan int)
+	wg := sync.WaitGroup{}
+	wg.Add(parallelism)
+
+	for w := 0; w < parallelism; w++ {
+		go func() {
+			defer wg.Done()
+			for item := range jobs {
+				run(item)
+			}
+		}()
+	}
+
+	for item := 0; item < n; item++ {
+		jobs <- item
+	}
+	close(jobs)
+
+	wg.Wait()
+}